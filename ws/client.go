@@ -0,0 +1,191 @@
+package ws
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+type DialOptions struct {
+	SocketOptions
+	// Header holds additional headers sent along with the upgrade request
+	Header http.Header
+	// Subprotocols lists the offered subprotocols in order of preference
+	Subprotocols []string
+	// TLSConfig is used for wss:// urls, ServerName defaults to the url host
+	TLSConfig *tls.Config
+	// Extensions lists the offered extensions in order of preference
+	Extensions []Extension
+	// PerMessageDeflate offers compression to the server ahead of Extensions
+	PerMessageDeflate *DeflateOptions
+}
+
+// Dial connects to a ws:// or wss:// url and performs the opening handshake.
+// The context bounds the connection and handshake phase only.
+// The returned socket masks every frame it sends and refuses masked frames
+// from the server, Run must be called to start processing incoming frames
+func Dial(ctx context.Context, rawURL string, options DialOptions) (Socket, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	defaultPort := ""
+	switch u.Scheme {
+	case "ws":
+		defaultPort = "80"
+	case "wss":
+		defaultPort = "443"
+	default:
+		return nil, ErrInvalidScheme
+	}
+
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), defaultPort)
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	var tlsConn *tls.Conn
+	if u.Scheme == "wss" {
+		config := &tls.Config{}
+		if options.TLSConfig != nil {
+			config = options.TLSConfig.Clone()
+		}
+		if config.ServerName == "" {
+			config.ServerName = u.Hostname()
+		}
+		tlsConn = tls.Client(conn, config)
+		conn = tlsConn
+	}
+
+	s := newSocket(conn, nil)
+	s.isClient = true
+	s.applyOptions(options.SocketOptions)
+
+	errCh := make(chan error, 1)
+	go func() {
+		if tlsConn != nil {
+			if err := tlsConn.HandshakeContext(ctx); err != nil {
+				errCh <- err
+				return
+			}
+		}
+		errCh <- s.clientHandshake(u, options)
+	}()
+
+	select {
+	case err = <-errCh:
+	case <-ctx.Done():
+		conn.Close()
+		<-errCh
+		err = ctx.Err()
+	}
+
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (c *socket) clientHandshake(u *url.URL, options DialOptions) error {
+	key, err := generateWebsocketKey()
+	if err != nil {
+		c.setStatus(SocketStatusClosed)
+		return err
+	}
+
+	lines := []string{
+		fmt.Sprintf("GET %s HTTP/1.1", u.RequestURI()),
+		fmt.Sprintf("Host: %s", u.Host),
+		"Connection: Upgrade",
+		"Upgrade: websocket",
+		fmt.Sprintf("Sec-WebSocket-Key: %s", key),
+		fmt.Sprintf("Sec-WebSocket-Version: %s", WEBSOCKET_VERSION),
+	}
+	if len(options.Subprotocols) > 0 {
+		lines = append(lines, fmt.Sprintf("Sec-WebSocket-Protocol: %s", strings.Join(options.Subprotocols, ", ")))
+	}
+	if extensions := withDeflate(options.PerMessageDeflate, options.Extensions); len(extensions) > 0 {
+		offers := make([]ExtensionParams, len(extensions))
+		for i, extension := range extensions {
+			offers[i] = extension.Offer()
+		}
+		lines = append(lines, fmt.Sprintf("Sec-WebSocket-Extensions: %s", formatExtensions(offers)))
+	}
+	for name, values := range options.Header {
+		for _, value := range values {
+			lines = append(lines, fmt.Sprintf("%s: %s", name, value))
+		}
+	}
+	lines = append(lines, "\r\n")
+
+	if _, err := c.rwc.Write([]byte(strings.Join(lines, "\r\n"))); err != nil {
+		c.setStatus(SocketStatusClosed)
+		return err
+	}
+
+	res, err := http.ReadResponse(c.reader(), nil)
+	if err != nil {
+		c.setStatus(SocketStatusClosed)
+		return ErrMalformedHandshake
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		c.setStatus(SocketStatusClosed)
+		return ErrUnexpectedStatus
+	}
+
+	if !hasToken(headerTokens(res.Header, "Connection"), "upgrade") {
+		c.setStatus(SocketStatusClosed)
+		return ErrMissingUpgrade
+	}
+
+	if !hasToken(headerTokens(res.Header, "Upgrade"), "websocket") {
+		c.setStatus(SocketStatusClosed)
+		return ErrInvalidUpgrade
+	}
+
+	if res.Header.Get("Sec-WebSocket-Accept") != generateWebsocketAccept(key) {
+		c.setStatus(SocketStatusClosed)
+		return ErrInvalidAcceptKey
+	}
+
+	// the server may pick none of the offered subprotocols, but never one we did not offer
+	if protocol := res.Header.Get("Sec-WebSocket-Protocol"); protocol != "" {
+		if selectSubprotocol([]string{protocol}, options.Subprotocols) == "" {
+			c.setStatus(SocketStatusClosed)
+			return ErrInvalidSubprotocol
+		}
+		c.subprotocol = protocol
+	}
+
+	c.extensionParams = parseExtensions(strings.Join(res.Header.Values("Sec-WebSocket-Extensions"), ", "))
+	if c.extensions, err = configureExtensions(c.extensionParams, withDeflate(options.PerMessageDeflate, options.Extensions)); err != nil {
+		c.setStatus(SocketStatusClosed)
+		return err
+	}
+
+	c.setStatus(SocketStatusOpen)
+	return nil
+}
+
+// generateWebsocketKey returns a base64 encoded random 16 bytes nonce
+func generateWebsocketKey() (string, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(nonce), nil
+}
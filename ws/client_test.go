@@ -0,0 +1,210 @@
+package ws
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestEchoServer(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s, err := NewUpgrader().Upgrade(w, r)
+		if err != nil {
+			t.Error("Unexpected upgrade error", err)
+			return
+		}
+		s.OnText(func(text string) {
+			s.SendMessage(MESSAGE_TYPE_TEXT, strings.NewReader(text))
+		})
+		go s.Run()
+	}))
+}
+
+func TestDialEcho(t *testing.T) {
+	srv := newTestEchoServer(t)
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	s, err := Dial(ctx, "ws"+strings.TrimPrefix(srv.URL, "http"), DialOptions{})
+	if err != nil {
+		t.Fatal("Unexpected dial error", err)
+	}
+
+	received := make(chan string, 1)
+	s.OnText(func(text string) {
+		received <- text
+	})
+	go s.Run()
+
+	if err := s.SendMessage(MESSAGE_TYPE_TEXT, strings.NewReader("hello")); err != nil {
+		t.Fatal("Unexpected send error", err)
+	}
+
+	select {
+	case text := <-received:
+		if text != "hello" {
+			t.Error("Unexpected echo", text)
+		}
+	case <-ctx.Done():
+		t.Fatal("Echo not received")
+	}
+	s.Close()
+}
+
+func TestDialInvalidScheme(t *testing.T) {
+	if _, err := Dial(context.Background(), "http://localhost", DialOptions{}); err != ErrInvalidScheme {
+		t.Error("Unexpected dial error", err)
+	}
+}
+
+func TestClientRejectsMaskedFrames(t *testing.T) {
+	payloadReader := bytes.NewReader([]byte("hello"))
+	data := encodeFrame(FrameEncodeOptions{
+		r:             payloadReader,
+		payloadLength: uint64(payloadReader.Len()),
+		opCode:        OPCODE_TEXT,
+		fin:           true,
+		mask:          true,
+	})
+
+	_, err := decodeFrame(decodeFrameSettings{
+		reader:       bytes.NewReader(data),
+		expectedMask: false,
+	})
+	if err != ErrMaskedFrame {
+		t.Error("Masked frame accepted by client", err)
+	}
+}
+
+func TestSubprotocolNegotiation(t *testing.T) {
+	serverProtocol := make(chan string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u := NewUpgraderWithOptions(ServerOptions{Subprotocols: []string{"chat.v2", "chat.v1"}})
+		s, err := u.Upgrade(w, r)
+		if err != nil {
+			t.Error("Unexpected upgrade error", err)
+			return
+		}
+		serverProtocol <- s.Subprotocol()
+		go s.Run()
+	}))
+	defer srv.Close()
+
+	s, err := Dial(context.Background(), "ws"+strings.TrimPrefix(srv.URL, "http"), DialOptions{
+		Subprotocols: []string{"chat.v1", "chat.v2"},
+	})
+	if err != nil {
+		t.Fatal("Unexpected dial error", err)
+	}
+	defer s.Close()
+
+	if s.Subprotocol() != "chat.v2" {
+		t.Error("Unexpected client subprotocol", s.Subprotocol())
+	}
+	if protocol := <-serverProtocol; protocol != "chat.v2" {
+		t.Error("Unexpected server subprotocol", protocol)
+	}
+}
+
+type closeEvent struct {
+	code   uint16
+	reason string
+	remote bool
+}
+
+func TestCloseWithCode(t *testing.T) {
+	serverClosed := make(chan closeEvent, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s, err := NewUpgrader().Upgrade(w, r)
+		if err != nil {
+			t.Error("Unexpected upgrade error", err)
+			return
+		}
+		s.OnClose(func(code uint16, reason string, remote bool) {
+			serverClosed <- closeEvent{code, reason, remote}
+		})
+		go s.Run()
+	}))
+	defer srv.Close()
+
+	s, err := Dial(context.Background(), "ws"+strings.TrimPrefix(srv.URL, "http"), DialOptions{})
+	if err != nil {
+		t.Fatal("Unexpected dial error", err)
+	}
+	clientClosed := make(chan closeEvent, 1)
+	s.OnClose(func(code uint16, reason string, remote bool) {
+		clientClosed <- closeEvent{code, reason, remote}
+	})
+
+	if err := s.CloseWithCode(2999, ""); err != ErrInvalidCloseCode {
+		t.Error("Invalid code accepted", err)
+	}
+	if err := s.CloseWithCode(4001, strings.Repeat("x", MaxCloseReasonLength+1)); err != ErrInvalidCloseReason {
+		t.Error("Long reason accepted", err)
+	}
+	if err := s.CloseWithCode(4001, "\xff"); err != ErrInvalidCloseReason {
+		t.Error("Invalid UTF-8 reason accepted", err)
+	}
+
+	if err := s.CloseWithCode(4001, "bye"); err != nil {
+		t.Fatal("Unexpected close error", err)
+	}
+	if e := <-clientClosed; e != (closeEvent{4001, "bye", false}) {
+		t.Error("Unexpected client close event", e)
+	}
+	select {
+	case e := <-serverClosed:
+		if e != (closeEvent{4001, "bye", true}) {
+			t.Error("Unexpected server close event", e)
+		}
+	case <-time.After(time.Second):
+		t.Error("Server close handler not called")
+	}
+}
+
+func TestDialReceivesEarlyMessage(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hijacker := w.(http.Hijacker)
+		conn, bufrw, err := hijacker.Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+
+		// the response and the first message are sent in a single write
+		response := handshakeResponse(generateWebsocketAccept(r.Header.Get("Sec-WebSocket-Key")))
+		message := encodeFrame(FrameEncodeOptions{
+			r:             strings.NewReader("welcome"),
+			payloadLength: 7,
+			opCode:        OPCODE_TEXT,
+			fin:           true,
+		})
+		bufrw.Write(append([]byte(response), message...))
+		bufrw.Flush()
+		time.Sleep(100 * time.Millisecond)
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	s, err := Dial(ctx, "ws"+strings.TrimPrefix(srv.URL, "http"), DialOptions{
+		SocketOptions: SocketOptions{PullMessages: true},
+	})
+	if err != nil {
+		t.Fatal("Unexpected dial error", err)
+	}
+	go s.Run()
+	defer s.Close()
+
+	messageType, payload, err := s.ReadMessage(ctx)
+	if err != nil || messageType != MESSAGE_TYPE_TEXT || string(payload) != "welcome" {
+		t.Error("Early message lost", string(payload), err)
+	}
+}
@@ -0,0 +1,235 @@
+package ws
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+const (
+	PERMESSAGE_DEFLATE = "permessage-deflate"
+	// flate windows are at most 32KB, the largest size allowed by RFC 7692
+	maxDeflateWindowBits = 15
+	maxDeflateWindowSize = 1 << maxDeflateWindowBits
+)
+
+// deflateTail completes a message compressed with a sync flush, which RFC 7692
+// strips from the wire, and terminates the stream with an empty final block
+var deflateTail = []byte{0x00, 0x00, 0xff, 0xff, 0x01, 0x00, 0x00, 0xff, 0xff}
+
+// DeflateOptions configures the permessage-deflate extension (RFC 7692).
+// Compressed messages are inflated as a whole and always delivered to
+// OnText/OnBinary, even when they were fragmented
+type DeflateOptions struct {
+	// ServerNoContextTakeover makes the server reset its compression context for every message
+	ServerNoContextTakeover bool
+	// ClientNoContextTakeover makes the client reset its compression context for every message
+	ClientNoContextTakeover bool
+	// Level is the compress/flate compression level, zero means flate.DefaultCompression
+	Level int
+}
+
+type perMessageDeflate struct {
+	options DeflateOptions
+}
+
+// deflateState holds the per connection compression contexts
+type deflateState struct {
+	level             int
+	noContextTakeover bool
+	writer            *flate.Writer
+	compressed        bytes.Buffer
+	reader            io.ReadCloser
+	history           []byte
+	readLimit         uint64
+}
+
+// withDeflate puts permessage-deflate in front of the other extensions when configured
+func withDeflate(options *DeflateOptions, extensions []Extension) []Extension {
+	if options == nil {
+		return extensions
+	}
+	return append([]Extension{NewPerMessageDeflate(*options)}, extensions...)
+}
+
+func NewPerMessageDeflate(options DeflateOptions) Extension {
+	return &perMessageDeflate{
+		options: options,
+	}
+}
+
+func (e *perMessageDeflate) Name() string {
+	return PERMESSAGE_DEFLATE
+}
+
+func (e *perMessageDeflate) Offer() ExtensionParams {
+	offer := ExtensionParams{
+		Name:   PERMESSAGE_DEFLATE,
+		Params: map[string]string{},
+	}
+	if e.options.ServerNoContextTakeover {
+		offer.Params["server_no_context_takeover"] = ""
+	}
+	if e.options.ClientNoContextTakeover {
+		offer.Params["client_no_context_takeover"] = ""
+	}
+	return offer
+}
+
+// Accept declines offers limiting the server window
+// since compress/flate always compresses with a full 32KB window
+func (e *perMessageDeflate) Accept(offer ExtensionParams) (ExtensionParams, ExtensionCodec, bool) {
+	if !validDeflateParams(offer.Params) {
+		return ExtensionParams{}, nil, false
+	}
+
+	if bits, ok := offer.Params["server_max_window_bits"]; ok && bits != strconv.Itoa(maxDeflateWindowBits) {
+		return ExtensionParams{}, nil, false
+	}
+
+	response := ExtensionParams{
+		Name:   PERMESSAGE_DEFLATE,
+		Params: map[string]string{},
+	}
+	_, serverNoContextTakeover := offer.Params["server_no_context_takeover"]
+	serverNoContextTakeover = serverNoContextTakeover || e.options.ServerNoContextTakeover
+	if serverNoContextTakeover {
+		response.Params["server_no_context_takeover"] = ""
+	}
+	if e.options.ClientNoContextTakeover {
+		response.Params["client_no_context_takeover"] = ""
+	}
+
+	return response, newDeflateState(e.options.Level, serverNoContextTakeover), true
+}
+
+// Configure refuses client_max_window_bits as we never offer it
+func (e *perMessageDeflate) Configure(response ExtensionParams) (ExtensionCodec, error) {
+	if !validDeflateParams(response.Params) {
+		return nil, ErrInvalidExtension
+	}
+	if _, ok := response.Params["client_max_window_bits"]; ok {
+		return nil, ErrInvalidExtension
+	}
+	_, clientNoContextTakeover := response.Params["client_no_context_takeover"]
+	return newDeflateState(e.options.Level, clientNoContextTakeover || e.options.ClientNoContextTakeover), nil
+}
+
+func validDeflateParams(params map[string]string) bool {
+	for key, value := range params {
+		switch key {
+		case "server_no_context_takeover", "client_no_context_takeover":
+			if value != "" {
+				return false
+			}
+		case "server_max_window_bits", "client_max_window_bits":
+			if value == "" && key == "client_max_window_bits" {
+				continue
+			}
+			bits, err := strconv.Atoi(value)
+			if err != nil || bits < 8 || bits > maxDeflateWindowBits {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+func newDeflateState(level int, noContextTakeover bool) *deflateState {
+	if level == 0 {
+		level = flate.DefaultCompression
+	}
+	return &deflateState{
+		level:             level,
+		noContextTakeover: noContextTakeover,
+	}
+}
+
+func (d *deflateState) RSV() byte {
+	return RSV1
+}
+
+// PreparedKey allows sharing compressed messages between connections
+// only when every message is compressed from a fresh context
+func (d *deflateState) PreparedKey() (string, bool) {
+	if !d.noContextTakeover {
+		return "", false
+	}
+	return fmt.Sprintf("%s;level=%d", PERMESSAGE_DEFLATE, d.level), true
+}
+
+func (d *deflateState) Encode(opcode byte, payload []byte) ([]byte, byte, error) {
+	compressed, err := d.compress(payload)
+	return compressed, RSV1, err
+}
+
+func (d *deflateState) Decode(opcode byte, rsv byte, payload []byte) ([]byte, error) {
+	if rsv&RSV1 == 0 {
+		return payload, nil
+	}
+	return d.decompress(payload)
+}
+
+func (d *deflateState) setReadLimit(limit uint64) {
+	d.readLimit = limit
+}
+
+// compress deflates a whole message payload, stripping the trailing
+// empty block produced by the sync flush as required by RFC 7692
+func (d *deflateState) compress(payload []byte) ([]byte, error) {
+	d.compressed.Reset()
+	if d.writer == nil {
+		w, err := flate.NewWriter(&d.compressed, d.level)
+		if err != nil {
+			return nil, err
+		}
+		d.writer = w
+	} else if d.noContextTakeover {
+		d.writer.Reset(&d.compressed)
+	}
+
+	if _, err := d.writer.Write(payload); err != nil {
+		return nil, err
+	}
+	if err := d.writer.Flush(); err != nil {
+		return nil, err
+	}
+
+	compressed := d.compressed.Bytes()
+	return append([]byte{}, compressed[:len(compressed)-4]...), nil
+}
+
+// decompress inflates a whole message payload.
+// The last 32KB of inflated data are kept as dictionary for the next message,
+// which is harmless when the peer does not take over its context
+func (d *deflateState) decompress(payload []byte) ([]byte, error) {
+	src := io.MultiReader(bytes.NewReader(payload), bytes.NewReader(deflateTail))
+	if d.reader == nil {
+		d.reader = flate.NewReaderDict(src, d.history)
+	} else if err := d.reader.(flate.Resetter).Reset(src, d.history); err != nil {
+		return nil, err
+	}
+
+	var r io.Reader = d.reader
+	if d.readLimit > 0 {
+		// stop inflating as soon as the message is known to be too big
+		r = io.LimitReader(d.reader, int64(d.readLimit)+1)
+	}
+	inflated, err := io.ReadAll(r)
+	if err != nil {
+		return nil, ErrInvalidCompressedData
+	}
+	if d.readLimit > 0 && uint64(len(inflated)) > d.readLimit {
+		return nil, ErrMessageTooBig
+	}
+
+	d.history = append(d.history, inflated...)
+	if len(d.history) > maxDeflateWindowSize {
+		d.history = append([]byte{}, d.history[len(d.history)-maxDeflateWindowSize:]...)
+	}
+	return inflated, nil
+}
@@ -0,0 +1,100 @@
+package ws
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDeflateRoundTrip(t *testing.T) {
+	for _, noContextTakeover := range []bool{false, true} {
+		sender := newDeflateState(0, noContextTakeover)
+		receiver := newDeflateState(0, false)
+
+		for _, message := range []string{"", "hello hello hello", "hello hello hello", strings.Repeat("abc", 20000)} {
+			compressed, err := sender.compress([]byte(message))
+			if err != nil {
+				t.Fatal("Unexpected compression error", err)
+			}
+			inflated, err := receiver.decompress(compressed)
+			if err != nil {
+				t.Fatal("Unexpected decompression error", err)
+			}
+			if string(inflated) != message {
+				t.Errorf("Round trip mismatch with noContextTakeover=%t", noContextTakeover)
+			}
+		}
+	}
+}
+
+func TestNegotiateDeflate(t *testing.T) {
+	offers := parseExtensions("permessage-deflate; server_max_window_bits=10, permessage-deflate; server_no_context_takeover; client_max_window_bits")
+	supported := []Extension{NewPerMessageDeflate(DeflateOptions{})}
+	responses, codecs := negotiateExtensions(offers, supported)
+	if len(responses) != 1 {
+		t.Fatal("No offer accepted")
+	}
+	if _, ok := responses[0].Params["server_no_context_takeover"]; !ok || !codecs[0].(*deflateState).noContextTakeover {
+		t.Error("server_no_context_takeover not honoured", responses[0])
+	}
+	if _, ok := responses[0].Params["server_max_window_bits"]; ok {
+		t.Error("Declined offer used", responses[0])
+	}
+
+	if responses, _ := negotiateExtensions(parseExtensions("permessage-deflate; unknown"), supported); len(responses) != 0 {
+		t.Error("Offer with unknown parameter accepted")
+	}
+}
+
+func TestDeflateEcho(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s, err := NewUpgraderWithOptions(ServerOptions{PerMessageDeflate: &DeflateOptions{}}).Upgrade(w, r)
+		if err != nil {
+			t.Error("Unexpected upgrade error", err)
+			return
+		}
+		s.OnText(func(text string) {
+			s.SendMessage(MESSAGE_TYPE_TEXT, strings.NewReader(text))
+		})
+		go s.Run()
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	s, err := Dial(ctx, "ws"+strings.TrimPrefix(srv.URL, "http"), DialOptions{PerMessageDeflate: &DeflateOptions{}})
+	if err != nil {
+		t.Fatal("Unexpected dial error", err)
+	}
+	defer s.Close()
+
+	if extensions := s.Extensions(); len(extensions) != 1 || extensions[0].Name != PERMESSAGE_DEFLATE {
+		t.Fatal("Compression not negotiated")
+	}
+
+	received := make(chan string, 1)
+	s.OnText(func(text string) {
+		received <- text
+	})
+	s.SetMaxFrameSize(16)
+	go s.Run()
+
+	message := strings.Repeat(`{"price":42,"symbol":"ABC"}`, 100)
+	for i := 0; i < 2; i++ {
+		if err := s.SendMessage(MESSAGE_TYPE_TEXT, strings.NewReader(message)); err != nil {
+			t.Fatal("Unexpected send error", err)
+		}
+		select {
+		case text := <-received:
+			if text != message {
+				t.Error("Unexpected echo", text)
+			}
+		case <-ctx.Done():
+			t.Fatal("Echo not received")
+		}
+	}
+}
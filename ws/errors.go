@@ -14,4 +14,32 @@ var (
 	ErrFragmentedControlFrame = errors.New("FRAGMENTED CONTROL FRAME")
 	ErrInvalidClosePayload    = errors.New("INVALID CLOSE PAYLOAD")
 	ErrInvalidUTF8            = errors.New("INVALID UTF8")
+	ErrInvalidMessageType     = errors.New("INVALID MESSAGE TYPE")
+	ErrHijackUnsupported      = errors.New("CONNECTION HIJACKING NOT SUPPORTED")
+	ErrMaskedFrame            = errors.New("MASKED FRAME")
+	ErrInvalidScheme          = errors.New("INVALID URL SCHEME")
+	ErrUnexpectedStatus       = errors.New("UNEXPECTED HANDSHAKE STATUS")
+	ErrInvalidAcceptKey       = errors.New("INVALID WEBSOCKET ACCEPT KEY")
+	ErrInvalidSubprotocol     = errors.New("INVALID SUBPROTOCOL")
+	ErrInvalidExtension       = errors.New("INVALID EXTENSION")
+	ErrInvalidCompressedData  = errors.New("INVALID COMPRESSED DATA")
+	ErrServerClosed           = errors.New("SERVER CLOSED")
+	ErrDeadlineUnsupported    = errors.New("DEADLINE NOT SUPPORTED")
+	ErrSocketNotOpen          = errors.New("SOCKET NOT OPEN")
+	ErrControlPayloadTooLong  = errors.New("CONTROL FRAME PAYLOAD TOO LONG")
+	ErrInvalidCloseCode       = errors.New("INVALID CLOSE CODE")
+	ErrInvalidCloseReason     = errors.New("INVALID CLOSE REASON")
+	ErrFrameTooBig            = errors.New("FRAME TOO BIG")
+	ErrMessageTooBig          = errors.New("MESSAGE TOO BIG")
+	ErrWriterClosed           = errors.New("WRITER CLOSED")
+	ErrMalformedHandshake     = errors.New("MALFORMED HANDSHAKE")
+	ErrInvalidMethod          = errors.New("INVALID METHOD")
+	ErrInvalidHTTPVersion     = errors.New("INVALID HTTP VERSION")
+	ErrMissingHost            = errors.New("MISSING HOST")
+	ErrUnsupportedVersion     = errors.New("UNSUPPORTED WEBSOCKET VERSION")
+	ErrUpgradeRejected        = errors.New("UPGRADE REJECTED")
+	ErrForbiddenOrigin        = errors.New("FORBIDDEN ORIGIN")
+	ErrPullMessagesDisabled   = errors.New("PULL MESSAGES DISABLED")
+	ErrWriteTimeout           = errors.New("WRITE TIMEOUT")
+	ErrHandshakeTooLarge      = errors.New("HANDSHAKE HEADER TOO LARGE")
 )
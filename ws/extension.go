@@ -0,0 +1,141 @@
+package ws
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ExtensionParams is a single element of a Sec-WebSocket-Extensions header
+type ExtensionParams struct {
+	Name string
+	// Params maps parameter names to their values, empty for valueless parameters
+	Params map[string]string
+}
+
+// Extension takes part in the opening handshake and creates the codec
+// applied to the messages of each connection it is negotiated on
+type Extension interface {
+	// Name returns the extension token used in Sec-WebSocket-Extensions
+	Name() string
+	// Offer returns the parameters sent by a client
+	Offer() ExtensionParams
+	// Accept is called by a server with a client offer for this extension.
+	// Returning false declines the offer, the next one is tried if any
+	Accept(offer ExtensionParams) (ExtensionParams, ExtensionCodec, bool)
+	// Configure is called by a client with the parameters accepted by the server
+	Configure(response ExtensionParams) (ExtensionCodec, error)
+}
+
+// ExtensionCodec transforms the messages of a single connection.
+// Outgoing messages go through the negotiated codecs in negotiation order,
+// incoming messages in reverse order.
+// Incoming messages without any RSV bit set on their first frame bypass the codecs,
+// otherwise their frames are reassembled before being decoded
+type ExtensionCodec interface {
+	// RSV returns the RSV bits owned by the extension
+	RSV() byte
+	// Encode transforms an outgoing message and returns the RSV bits to set on its first frame
+	Encode(opcode byte, payload []byte) ([]byte, byte, error)
+	// Decode transforms an incoming message given the RSV bits of its first frame
+	Decode(opcode byte, rsv byte, payload []byte) ([]byte, error)
+}
+
+func (e ExtensionParams) String() string {
+	parts := []string{e.Name}
+	for key, value := range e.Params {
+		if value == "" {
+			parts = append(parts, key)
+		} else {
+			parts = append(parts, fmt.Sprintf("%s=%s", key, value))
+		}
+	}
+	return strings.Join(parts, "; ")
+}
+
+// parseExtensions parses a Sec-WebSocket-Extensions header value
+// into its comma separated extensions and their parameters
+func parseExtensions(value string) []ExtensionParams {
+	var extensions []ExtensionParams
+	for _, extension := range parseTokenList(value) {
+		parts := strings.Split(extension, ";")
+		e := ExtensionParams{
+			Name:   strings.TrimSpace(parts[0]),
+			Params: map[string]string{},
+		}
+		for _, param := range parts[1:] {
+			key, value, _ := strings.Cut(param, "=")
+			e.Params[strings.TrimSpace(key)] = strings.Trim(strings.TrimSpace(value), "\"")
+		}
+		extensions = append(extensions, e)
+	}
+	return extensions
+}
+
+func formatExtensions(extensions []ExtensionParams) string {
+	values := make([]string, len(extensions))
+	for i, e := range extensions {
+		values[i] = e.String()
+	}
+	return strings.Join(values, ", ")
+}
+
+// negotiateExtensions lets every supported extension, in order of preference,
+// accept the first acceptable client offer.
+// Extensions claiming RSV bits already owned by an accepted one are skipped
+func negotiateExtensions(offers []ExtensionParams, supported []Extension) ([]ExtensionParams, []ExtensionCodec) {
+	var accepted []ExtensionParams
+	var codecs []ExtensionCodec
+	claimedRSV := byte(0)
+
+	for _, extension := range supported {
+		for _, offer := range offers {
+			if offer.Name != extension.Name() {
+				continue
+			}
+			response, codec, ok := extension.Accept(offer)
+			if !ok {
+				continue
+			}
+			if codec.RSV()&claimedRSV != 0 {
+				break
+			}
+			claimedRSV |= codec.RSV()
+			accepted = append(accepted, response)
+			codecs = append(codecs, codec)
+			break
+		}
+	}
+	return accepted, codecs
+}
+
+// configureExtensions validates the extensions accepted by a server:
+// each must have been offered, at most once, and own distinct RSV bits
+func configureExtensions(responses []ExtensionParams, offered []Extension) ([]ExtensionCodec, error) {
+	var codecs []ExtensionCodec
+	claimedRSV := byte(0)
+	used := map[string]bool{}
+
+	for _, response := range responses {
+		var extension Extension
+		for _, e := range offered {
+			if e.Name() == response.Name {
+				extension = e
+			}
+		}
+		if extension == nil || used[response.Name] {
+			return nil, ErrInvalidExtension
+		}
+		used[response.Name] = true
+
+		codec, err := extension.Configure(response)
+		if err != nil {
+			return nil, err
+		}
+		if codec.RSV()&claimedRSV != 0 {
+			return nil, ErrInvalidExtension
+		}
+		claimedRSV |= codec.RSV()
+		codecs = append(codecs, codec)
+	}
+	return codecs, nil
+}
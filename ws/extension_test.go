@@ -0,0 +1,139 @@
+package ws
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// xorExtension flips every payload byte and flags transformed messages with RSV2
+type xorExtension struct{}
+
+func (xorExtension) Name() string {
+	return "x-xor"
+}
+
+func (xorExtension) Offer() ExtensionParams {
+	return ExtensionParams{Name: "x-xor"}
+}
+
+func (xorExtension) Accept(offer ExtensionParams) (ExtensionParams, ExtensionCodec, bool) {
+	return ExtensionParams{Name: "x-xor"}, xorExtension{}, true
+}
+
+func (xorExtension) Configure(response ExtensionParams) (ExtensionCodec, error) {
+	return xorExtension{}, nil
+}
+
+func (xorExtension) RSV() byte {
+	return RSV2
+}
+
+func (xorExtension) Encode(opcode byte, payload []byte) ([]byte, byte, error) {
+	return xorBytes(payload), RSV2, nil
+}
+
+func (xorExtension) Decode(opcode byte, rsv byte, payload []byte) ([]byte, error) {
+	if rsv&RSV2 == 0 {
+		return payload, nil
+	}
+	return xorBytes(payload), nil
+}
+
+func xorBytes(payload []byte) []byte {
+	transformed := make([]byte, len(payload))
+	for i, b := range payload {
+		transformed[i] = b ^ 0xff
+	}
+	return transformed
+}
+
+func TestRSVRequiresNegotiatedExtension(t *testing.T) {
+	payloadReader := bytes.NewReader([]byte("hello"))
+	data := encodeFrame(FrameEncodeOptions{
+		r:             payloadReader,
+		payloadLength: uint64(payloadReader.Len()),
+		opCode:        OPCODE_TEXT,
+		rsv:           RSV2,
+		fin:           true,
+		mask:          true,
+	})
+
+	for _, allowed := range []byte{0, RSV1} {
+		_, err := decodeFrame(decodeFrameSettings{
+			reader:       bytes.NewReader(data),
+			expectedMask: true,
+			allowedRSV:   allowed,
+		})
+		if err != ErrInvalidRSV {
+			t.Error("RSV2 accepted without owner", err)
+		}
+	}
+
+	f, err := decodeFrame(decodeFrameSettings{
+		reader:       bytes.NewReader(data),
+		expectedMask: true,
+		allowedRSV:   RSV2,
+	})
+	if err != nil || f.rsv() != RSV2 {
+		t.Error("RSV2 refused with owner", err)
+	}
+}
+
+func TestExtensionsChain(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u := NewUpgraderWithOptions(ServerOptions{
+			Extensions:        []Extension{xorExtension{}},
+			PerMessageDeflate: &DeflateOptions{},
+		})
+		s, err := u.Upgrade(w, r)
+		if err != nil {
+			t.Error("Unexpected upgrade error", err)
+			return
+		}
+		s.OnText(func(text string) {
+			s.SendMessage(MESSAGE_TYPE_TEXT, strings.NewReader(text))
+		})
+		go s.Run()
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	s, err := Dial(ctx, "ws"+strings.TrimPrefix(srv.URL, "http"), DialOptions{
+		Extensions:        []Extension{xorExtension{}},
+		PerMessageDeflate: &DeflateOptions{},
+	})
+	if err != nil {
+		t.Fatal("Unexpected dial error", err)
+	}
+	defer s.Close()
+
+	extensions := s.Extensions()
+	if len(extensions) != 2 || extensions[0].Name != PERMESSAGE_DEFLATE || extensions[1].Name != "x-xor" {
+		t.Fatal("Unexpected negotiated extensions", extensions)
+	}
+
+	received := make(chan string, 1)
+	s.OnText(func(text string) {
+		received <- text
+	})
+	go s.Run()
+
+	if err := s.SendMessage(MESSAGE_TYPE_TEXT, strings.NewReader("hello extensions")); err != nil {
+		t.Fatal("Unexpected send error", err)
+	}
+	select {
+	case text := <-received:
+		if text != "hello extensions" {
+			t.Error("Unexpected echo", text)
+		}
+	case <-ctx.Done():
+		t.Fatal("Echo not received")
+	}
+}
@@ -0,0 +1,165 @@
+package ws
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultBroadcastTimeout bounds the time a broadcast waits for a single socket write
+const DefaultBroadcastTimeout = 10 * time.Second
+
+type HubOptions struct {
+	// WriteTimeout bounds every socket write of a broadcast, including the wait
+	// for the other writes of the socket, zero means DefaultBroadcastTimeout
+	WriteTimeout time.Duration
+}
+
+// Hub groups sockets to broadcast messages to.
+// Sockets leave the hub automatically once their connection is closed
+type Hub struct {
+	options HubOptions
+	mu      sync.Mutex
+	members map[uint64]*hubMember
+}
+
+type hubMember struct {
+	socket Socket
+	left   chan struct{}
+}
+
+func NewHub() *Hub {
+	return NewHubWithOptions(HubOptions{})
+}
+
+func NewHubWithOptions(options HubOptions) *Hub {
+	if options.WriteTimeout <= 0 {
+		options.WriteTimeout = DefaultBroadcastTimeout
+	}
+	return &Hub{
+		options: options,
+		members: map[uint64]*hubMember{},
+	}
+}
+
+func (h *Hub) Join(s Socket) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.members[s.ID()]; ok {
+		return
+	}
+	m := &hubMember{
+		socket: s,
+		left:   make(chan struct{}),
+	}
+	h.members[s.ID()] = m
+
+	go func() {
+		select {
+		case <-s.Done():
+			h.Leave(s)
+		case <-m.left:
+		}
+	}()
+}
+
+func (h *Hub) Leave(s Socket) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if m, ok := h.members[s.ID()]; ok {
+		delete(h.members, s.ID())
+		close(m.left)
+	}
+}
+
+// Members returns a snapshot of the sockets in the hub
+func (h *Hub) Members() []Socket {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	members := make([]Socket, 0, len(h.members))
+	for _, m := range h.members {
+		members = append(members, m.socket)
+	}
+	return members
+}
+
+func (h *Hub) Count() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.members)
+}
+
+// Broadcast sends the message to every member concurrently, encoding it once
+// per wire configuration, and returns the errors of the failed members.
+// A member that does not complete its write within the write timeout is closed,
+// as well as any member whose write fails, since a partially written frame
+// cannot be recovered
+func (h *Hub) Broadcast(t MessageType, payload []byte) map[Socket]error {
+	pm, err := NewPreparedMessage(t, payload)
+	if err != nil {
+		errs := map[Socket]error{}
+		for _, s := range h.Members() {
+			errs[s] = err
+		}
+		return errs
+	}
+	return h.BroadcastPrepared(pm)
+}
+
+// BroadcastPrepared behaves as Broadcast with an already prepared message
+func (h *Hub) BroadcastPrepared(pm *PreparedMessage) map[Socket]error {
+	members := h.Members()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	errs := map[Socket]error{}
+
+	for _, s := range members {
+		wg.Add(1)
+		go func(s Socket) {
+			defer wg.Done()
+
+			if err := h.write(s, pm); err != nil {
+				mu.Lock()
+				errs[s] = err
+				mu.Unlock()
+			}
+		}(s)
+	}
+	wg.Wait()
+
+	return errs
+}
+
+// write sends a prepared message to a member within the write timeout, which also
+// bounds the wait for the other writes of the member. A member that fails or times out
+// is dropped, the broadcast does not wait for its write to return
+func (h *Hub) write(s Socket, pm *PreparedMessage) error {
+	written := make(chan error, 1)
+	go func() {
+		written <- s.WritePreparedMessage(pm)
+	}()
+
+	timer := time.NewTimer(h.options.WriteTimeout)
+	defer timer.Stop()
+
+	var err error
+	select {
+	case err = <-written:
+		if err == nil {
+			return nil
+		}
+	case <-timer.C:
+		err = ErrWriteTimeout
+	}
+
+	if d, ok := s.(interface{ drop() }); ok {
+		// closing the connection also fails the write in progress
+		d.drop()
+	} else {
+		go s.Close()
+	}
+	return err
+}
@@ -0,0 +1,152 @@
+package ws
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newPipeSocket returns an open server socket and the client end of its connection
+func newPipeSocket(extensions ...ExtensionCodec) (*socket, net.Conn) {
+	serverConn, clientConn := net.Pipe()
+	s := newSocket(serverConn, nil)
+	s.setStatus(SocketStatusOpen)
+	s.extensions = extensions
+	return s, clientConn
+}
+
+// readMessage decodes a single unfragmented message sent by a server socket
+func readMessage(conn net.Conn, codec ExtensionCodec) (string, error) {
+	f, err := decodeFrame(decodeFrameSettings{reader: conn, allowedRSV: RSV1})
+	if err != nil {
+		return "", err
+	}
+	payload := f.Payload
+	if codec != nil {
+		payload, err = codec.Decode(f.Opcode, f.rsv(), payload)
+	}
+	return string(payload), err
+}
+
+func TestHubBroadcast(t *testing.T) {
+	hub := NewHubWithOptions(HubOptions{WriteTimeout: 100 * time.Millisecond})
+
+	plain, plainConn := newPipeSocket()
+	compressedA, compressedAConn := newPipeSocket(newDeflateState(0, true))
+	compressedB, compressedBConn := newPipeSocket(newDeflateState(0, true))
+	slow, slowConn := newPipeSocket()
+	defer slowConn.Close()
+
+	received := make(chan string, 3)
+	for _, c := range []struct {
+		conn  net.Conn
+		codec ExtensionCodec
+	}{{plainConn, nil}, {compressedAConn, newDeflateState(0, false)}, {compressedBConn, newDeflateState(0, false)}} {
+		go func(conn net.Conn, codec ExtensionCodec) {
+			text, err := readMessage(conn, codec)
+			if err != nil {
+				t.Error("Unexpected read error", err)
+			}
+			received <- text
+		}(c.conn, c.codec)
+	}
+
+	for _, s := range []Socket{plain, compressedA, compressedB, slow} {
+		hub.Join(s)
+	}
+	if hub.Count() != 4 {
+		t.Fatal("Unexpected member count", hub.Count())
+	}
+
+	pm, err := NewPreparedMessage(MESSAGE_TYPE_TEXT, []byte("market update"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	errs := hub.BroadcastPrepared(pm)
+	if len(errs) != 1 || errs[slow] == nil {
+		t.Error("Unexpected broadcast errors", errs)
+	}
+
+	for i := 0; i < 3; i++ {
+		if text := <-received; text != "market update" {
+			t.Error("Unexpected message", text)
+		}
+	}
+	if len(pm.frames) != 2 {
+		t.Error("Unexpected number of encodings", len(pm.frames))
+	}
+
+	// the slow member was closed and left the hub
+	waitFor(t, func() bool { return hub.Count() == 3 })
+}
+
+// deadlineConn records the write deadlines set on a connection
+type deadlineConn struct {
+	net.Conn
+	mu        sync.Mutex
+	deadlines []time.Time
+}
+
+func (c *deadlineConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.deadlines = append(c.deadlines, t)
+	c.mu.Unlock()
+	return c.Conn.SetWriteDeadline(t)
+}
+
+func TestBroadcastKeepsWriteDeadline(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	conn := &deadlineConn{Conn: serverConn}
+	s := newSocket(conn, nil)
+	s.setStatus(SocketStatusOpen)
+
+	deadline := time.Now().Add(time.Hour)
+	if err := s.SetWriteDeadline(deadline); err != nil {
+		t.Fatal(err)
+	}
+
+	go readMessage(clientConn, nil)
+	hub := NewHubWithOptions(HubOptions{WriteTimeout: time.Second})
+	hub.Join(s)
+	if errs := hub.Broadcast(MESSAGE_TYPE_TEXT, []byte("tick")); len(errs) != 0 {
+		t.Fatal("Unexpected broadcast errors", errs)
+	}
+
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if len(conn.deadlines) != 1 || !conn.deadlines[0].Equal(deadline) {
+		t.Error("Broadcast changed the write deadline", conn.deadlines)
+	}
+}
+
+func TestBroadcastBusyMember(t *testing.T) {
+	hub := NewHubWithOptions(HubOptions{WriteTimeout: 50 * time.Millisecond})
+	busy, busyConn := newPipeSocket()
+	defer busyConn.Close()
+	hub.Join(busy)
+
+	// an application message is stuck on a peer that does not read
+	go busy.SendMessage(MESSAGE_TYPE_TEXT, bytes.NewReader([]byte("stuck")))
+	time.Sleep(10 * time.Millisecond)
+
+	broadcast := make(chan map[Socket]error, 1)
+	go func() {
+		broadcast <- hub.Broadcast(MESSAGE_TYPE_TEXT, []byte("tick"))
+	}()
+	select {
+	case errs := <-broadcast:
+		if errs[busy] != ErrWriteTimeout {
+			t.Error("Unexpected broadcast errors", errs)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Broadcast blocked on a busy member")
+	}
+	select {
+	case <-busy.Done():
+	case <-time.After(time.Second):
+		t.Error("Busy member not dropped")
+	}
+}
@@ -0,0 +1,75 @@
+package ws
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// OriginPolicy protects browser clients from cross-site websocket hijacking.
+// An origin is allowed as soon as one of the rules allows it; requests without
+// an Origin header do not come from browsers and are always allowed
+type OriginPolicy struct {
+	// AllowedOrigins lists the allowed origins, such as "https://example.com".
+	// A "*." host prefix allows the subdomains, "https://*.example.com" allows
+	// "https://api.example.com" but not "https://example.com"
+	AllowedOrigins []string
+	// SameOrigin allows the origins whose host is the Host of the request
+	SameOrigin bool
+	// Check is a custom rule
+	Check func(origin *url.URL, req *http.Request) bool
+}
+
+// allows reports whether the request origin is allowed, a nil policy allows every origin
+func (p *OriginPolicy) allows(req *http.Request) bool {
+	if p == nil {
+		return true
+	}
+	values := req.Header.Values("Origin")
+	if len(values) == 0 {
+		return true
+	}
+	if len(values) > 1 {
+		return false
+	}
+
+	origin, err := url.Parse(values[0])
+	if err != nil || origin.Scheme == "" || origin.Host == "" {
+		// opaque origins such as "null" can only be allowed explicitly
+		return p.allowsExactly(values[0])
+	}
+
+	for _, pattern := range p.AllowedOrigins {
+		if matchOrigin(pattern, origin) {
+			return true
+		}
+	}
+	if p.SameOrigin && strings.EqualFold(origin.Host, req.Host) {
+		return true
+	}
+	return p.Check != nil && p.Check(origin, req)
+}
+
+func (p *OriginPolicy) allowsExactly(origin string) bool {
+	for _, pattern := range p.AllowedOrigins {
+		if pattern == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// matchOrigin compares the scheme, host and port of an origin to an allowed origin pattern
+func matchOrigin(pattern string, origin *url.URL) bool {
+	allowed, err := url.Parse(pattern)
+	if err != nil || !strings.EqualFold(allowed.Scheme, origin.Scheme) || allowed.Port() != origin.Port() {
+		return false
+	}
+
+	host := strings.ToLower(origin.Hostname())
+	allowedHost := strings.ToLower(allowed.Hostname())
+	if strings.HasPrefix(allowedHost, "*.") {
+		return strings.HasSuffix(host, allowedHost[1:])
+	}
+	return host == allowedHost
+}
@@ -0,0 +1,97 @@
+package ws
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestOriginPolicy(t *testing.T) {
+	policy := &OriginPolicy{
+		AllowedOrigins: []string{"https://example.com", "https://*.example.org", "http://localhost:3000"},
+		SameOrigin:     true,
+		Check: func(origin *url.URL, req *http.Request) bool {
+			return origin.Hostname() == "trusted.test"
+		},
+	}
+
+	cases := []struct {
+		origin  string
+		allowed bool
+	}{
+		{"", true},
+		{"https://example.com", true},
+		{"https://EXAMPLE.com", true},
+		{"http://example.com", false},
+		{"https://example.com:8443", false},
+		{"https://api.example.org", true},
+		{"https://a.b.example.org", true},
+		{"https://example.org", false},
+		{"https://evilexample.org", false},
+		{"http://localhost:3000", true},
+		{"http://localhost:4000", false},
+		{"https://ws.host.test:9000", true},
+		{"https://trusted.test", true},
+		{"null", false},
+		{"https://attacker.test", false},
+	}
+	for _, c := range cases {
+		req := &http.Request{Host: "ws.host.test:9000", Header: http.Header{}}
+		if c.origin != "" {
+			req.Header.Set("Origin", c.origin)
+		}
+		if policy.allows(req) != c.allowed {
+			t.Error("Unexpected policy decision", c.origin, !c.allowed)
+		}
+	}
+
+	var none *OriginPolicy
+	req := &http.Request{Header: http.Header{"Origin": {"https://attacker.test"}}}
+	if !none.allows(req) {
+		t.Error("Nil policy refused an origin")
+	}
+}
+
+func TestForbiddenOrigin(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServerWithOptions(ServerOptions{OriginPolicy: &OriginPolicy{SameOrigin: true}})
+	defer srv.Close()
+	accepted := make(chan error, 1)
+	go srv.Serve(ln, func(err error, s Socket) {
+		accepted <- err
+	})
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte(strings.Join([]string{
+		"GET / HTTP/1.1",
+		"Host: localhost",
+		"Origin: https://attacker.test",
+		"Connection: Upgrade",
+		"Upgrade: websocket",
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==",
+		"Sec-WebSocket-Version: 13",
+		"\r\n",
+	}, "\r\n")))
+
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusForbidden {
+		t.Error("Unexpected status code", res.StatusCode)
+	}
+	if err := <-accepted; err != ErrForbiddenOrigin {
+		t.Error("Unexpected accept error", err)
+	}
+}
@@ -0,0 +1,132 @@
+package ws
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// PreparedMessage is a message encoded once and shared by all the sockets it is sent to.
+// Wire frames are built on first use and cached per frame size and extension configuration,
+// sockets whose extensions keep a per connection state, and client sockets which must mask
+// every frame, encode the message on their own
+type PreparedMessage struct {
+	messageType MessageType
+	payload     []byte
+	mu          sync.Mutex
+	frames      map[string][]byte
+}
+
+// PreparedCodec is implemented by extension codecs whose encoding only depends on
+// their parameters, so that it can be shared by the sockets with the same key
+type PreparedCodec interface {
+	ExtensionCodec
+	PreparedKey() (string, bool)
+}
+
+func NewPreparedMessage(t MessageType, payload []byte) (*PreparedMessage, error) {
+	if t != MESSAGE_TYPE_TEXT && t != MESSAGE_TYPE_BINARY {
+		return nil, ErrInvalidMessageType
+	}
+	return &PreparedMessage{
+		messageType: t,
+		payload:     payload,
+		frames:      map[string][]byte{},
+	}, nil
+}
+
+// WritePreparedMessage sends a prepared message in a single write, reusing its cached
+// frames when possible. Frames are only cached when they can be shared with other sockets
+func (s *socket) WritePreparedMessage(pm *PreparedMessage) error {
+	s.messageMu.Lock()
+	defer s.messageMu.Unlock()
+
+	if s.Status() != SocketStatusOpen {
+		return ErrSocketNotOpen
+	}
+	encode := func() ([]byte, error) {
+		payload, rsv, err := s.encodeMessage(byte(pm.messageType), pm.payload)
+		if err != nil {
+			return nil, err
+		}
+		return encodeMessageFrames(byte(pm.messageType), rsv, payload, s.frameSize(), s.isClient), nil
+	}
+
+	var data []byte
+	var err error
+	if key, ok := s.preparedKey(); ok {
+		data, err = pm.encode(key, encode)
+	} else {
+		data, err = encode()
+	}
+	if err != nil {
+		return err
+	}
+
+	return s.writeData(data)
+}
+
+// preparedKey identifies the wire encoding of the socket messages
+func (s *socket) preparedKey() (string, bool) {
+	if s.isClient {
+		return "", false
+	}
+	parts := []string{fmt.Sprint(s.frameSize())}
+	for _, extension := range s.extensions {
+		codec, ok := extension.(PreparedCodec)
+		if !ok {
+			return "", false
+		}
+		key, ok := codec.PreparedKey()
+		if !ok {
+			return "", false
+		}
+		parts = append(parts, key)
+	}
+	return strings.Join(parts, "|"), true
+}
+
+func (pm *PreparedMessage) encode(key string, build func() ([]byte, error)) ([]byte, error) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	if data, ok := pm.frames[key]; ok {
+		return data, nil
+	}
+	data, err := build()
+	if err != nil {
+		return nil, err
+	}
+	pm.frames[key] = data
+	return data, nil
+}
+
+// encodeMessageFrames splits a whole message payload into consecutive frames,
+// rsv bits are set on the first frame only
+func encodeMessageFrames(opcode byte, rsv byte, payload []byte, frameSize int, mask bool) []byte {
+	var data []byte
+	for {
+		chunk := payload
+		if len(chunk) > frameSize {
+			chunk = chunk[:frameSize]
+		}
+		payload = payload[len(chunk):]
+		fin := len(payload) == 0
+
+		data = append(data, encodeFrame(FrameEncodeOptions{
+			r:             bytes.NewReader(chunk),
+			payloadLength: uint64(len(chunk)),
+			opCode:        opcode,
+			rsv:           rsv,
+			fin:           fin,
+			mask:          mask,
+		})...)
+
+		if fin {
+			return data
+		}
+		opcode = OPCODE_CONTINUATION
+		rsv = 0
+	}
+}
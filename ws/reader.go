@@ -0,0 +1,285 @@
+package ws
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+)
+
+// NextReader waits for the next message that no OnText, OnBinary or OnStreamStart
+// handler consumes and returns a reader over its payload. It requires the
+// PullMessages option, and no message is delivered once OnFrame is set.
+// Fragmented messages are streamed as their continuation frames arrive,
+// text is UTF-8 validated on the fly and the reader fails on invalid data.
+// Run must be running. Messages are queued until NextReader is called, so that the
+// read loop keeps answering control frames; the connection is failed with
+// CloseCodeMessageTooBig when the unread payloads exceed the message size limit
+func (s *socket) NextReader(ctx context.Context) (MessageType, io.Reader, error) {
+	m, err := s.nextMessage(ctx)
+	if err != nil {
+		return 0, nil, err
+	}
+	return m.messageType, m, nil
+}
+
+// ReadMessage waits for the next message, like NextReader, and returns its whole payload.
+// It gives up when ctx is done, even while the message is being received
+func (s *socket) ReadMessage(ctx context.Context) (MessageType, []byte, error) {
+	m, err := s.nextMessage(ctx)
+	if err != nil {
+		return 0, nil, err
+	}
+	payload, err := m.readAll(ctx)
+	if err != nil {
+		return 0, nil, err
+	}
+	return m.messageType, payload, nil
+}
+
+func (s *socket) nextMessage(ctx context.Context) (*pullMessage, error) {
+	if !s.pullMessages {
+		return nil, ErrPullMessagesDisabled
+	}
+	return s.incoming.pop(ctx, s.closing)
+}
+
+// startMessage picks where the payload of an incoming message is written:
+// the stream handler for fragmented messages, the text or binary handler
+// once the message is complete, or else a NextReader caller when the
+// PullMessages option is set. Messages nobody asked for are discarded
+func (s *socket) startMessage(t MessageType, fin bool) io.WriteCloser {
+	if !fin && s.streamStartHandler != nil {
+		r, w := io.Pipe()
+		s.streamStartHandler(t, r)
+		return w
+	}
+	if t == MESSAGE_TYPE_TEXT && s.textHandler != nil {
+		return &messageCollector{done: func(payload []byte) {
+			s.textHandler(string(payload))
+		}}
+	}
+	if t == MESSAGE_TYPE_BINARY && s.binaryHandler != nil {
+		return &messageCollector{done: s.binaryHandler}
+	}
+	if s.frameHandler != nil || !s.pullMessages {
+		// the frames were already handed over one by one, or are not wanted
+		return WriterNopCloser{io.Discard}
+	}
+
+	m := &pullMessage{messageType: t, queue: s.incoming, limit: s.messageLimit(), ready: make(chan struct{}, 1)}
+	s.incoming.push(m)
+	return m
+}
+
+// finishMessage closes the writer of the message being received,
+// a non nil err is reported to its reader
+func (s *socket) finishMessage(err error) {
+	if s.streamWriter == nil {
+		return
+	}
+	if w, ok := s.streamWriter.(interface{ CloseWithError(error) error }); ok && err != nil {
+		w.CloseWithError(err)
+	} else {
+		s.streamWriter.Close()
+	}
+	s.streamWriter = nil
+}
+
+// messageCollector buffers a message for the handlers expecting it whole
+type messageCollector struct {
+	buf  bytes.Buffer
+	done func(payload []byte)
+}
+
+func (c *messageCollector) Write(p []byte) (int, error) {
+	return c.buf.Write(p)
+}
+
+func (c *messageCollector) Close() error {
+	c.done(c.buf.Bytes())
+	return nil
+}
+
+// pullQueue holds the messages waiting for a NextReader caller,
+// along with the size of their unread payloads
+type pullQueue struct {
+	mu       sync.Mutex
+	messages []*pullMessage
+	buffered uint64
+	// ready is signaled when a message is queued
+	ready chan struct{}
+}
+
+func newPullQueue() *pullQueue {
+	return &pullQueue{ready: make(chan struct{}, 1)}
+}
+
+func (q *pullQueue) push(m *pullMessage) {
+	q.mu.Lock()
+	q.messages = append(q.messages, m)
+	q.mu.Unlock()
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// pop waits for the oldest queued message, the queued messages are still
+// delivered once the socket is closing
+func (q *pullQueue) pop(ctx context.Context, closing chan struct{}) (*pullMessage, error) {
+	for {
+		q.mu.Lock()
+		if len(q.messages) > 0 {
+			m := q.messages[0]
+			q.messages = q.messages[1:]
+			q.mu.Unlock()
+			return m, nil
+		}
+		q.mu.Unlock()
+
+		select {
+		case <-q.ready:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-closing:
+			return nil, ErrSocketNotOpen
+		}
+	}
+}
+
+// reserve accounts for n more unread bytes, unless that exceeds a non zero limit
+func (q *pullQueue) reserve(n int, limit uint64) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if limit > 0 && q.buffered+uint64(n) > limit {
+		return false
+	}
+	q.buffered += uint64(n)
+	return true
+}
+
+func (q *pullQueue) release(n int) {
+	q.mu.Lock()
+	q.buffered -= uint64(n)
+	q.mu.Unlock()
+}
+
+// pullMessage hands the frames of a message from the read loop to a NextReader caller.
+// Frames are queued so that the read loop never waits for the reader
+type pullMessage struct {
+	messageType MessageType
+	queue       *pullQueue
+	limit       uint64
+	mu          sync.Mutex
+	frames      [][]byte
+	err         error
+	closed      bool
+	discarded   bool
+	// ready is signaled when frames are queued or the message is closed
+	ready chan struct{}
+}
+
+// Write queues a frame payload for the reader, ErrMessageTooBig is returned
+// when the unread payloads of the socket would exceed the message size limit.
+// The payload is not copied, the read loop never reuses it
+func (m *pullMessage) Write(p []byte) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return 0, io.ErrClosedPipe
+	}
+	if len(p) == 0 || m.discarded {
+		return len(p), nil
+	}
+	if !m.queue.reserve(len(p), m.limit) {
+		return 0, ErrMessageTooBig
+	}
+	m.frames = append(m.frames, p)
+	m.signal()
+	return len(p), nil
+}
+
+// discard drops the unread payload of a message given up by its reader
+func (m *pullMessage) discard() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, frame := range m.frames {
+		m.queue.release(len(frame))
+	}
+	m.frames = nil
+	m.discarded = true
+}
+
+func (m *pullMessage) Close() error {
+	return m.CloseWithError(nil)
+}
+
+func (m *pullMessage) CloseWithError(err error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.closed {
+		m.closed = true
+		m.err = err
+		m.signal()
+	}
+	return nil
+}
+
+func (m *pullMessage) signal() {
+	select {
+	case m.ready <- struct{}{}:
+	default:
+	}
+}
+
+func (m *pullMessage) Read(p []byte) (int, error) {
+	for {
+		m.mu.Lock()
+		if len(m.frames) > 0 {
+			n := copy(p, m.frames[0])
+			m.frames[0] = m.frames[0][n:]
+			if len(m.frames[0]) == 0 {
+				m.frames = m.frames[1:]
+			}
+			m.queue.release(n)
+			m.mu.Unlock()
+			return n, nil
+		}
+		closed, err := m.closed, m.err
+		m.mu.Unlock()
+
+		if closed {
+			if err != nil {
+				return 0, err
+			}
+			return 0, io.EOF
+		}
+		<-m.ready
+	}
+}
+
+// readAll waits for the whole message, the message is discarded once ctx is done
+func (m *pullMessage) readAll(ctx context.Context) ([]byte, error) {
+	var payload []byte
+	for {
+		m.mu.Lock()
+		for _, frame := range m.frames {
+			payload = append(payload, frame...)
+			m.queue.release(len(frame))
+		}
+		m.frames = nil
+		closed, err := m.closed, m.err
+		m.mu.Unlock()
+
+		if closed {
+			return payload, err
+		}
+		select {
+		case <-m.ready:
+		case <-ctx.Done():
+			m.discard()
+			return nil, ctx.Err()
+		}
+	}
+}
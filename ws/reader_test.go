@@ -0,0 +1,205 @@
+package ws
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// writeClientFrame sends a masked frame, as a client would
+func writeClientFrame(conn net.Conn, opcode byte, payload []byte, fin bool) {
+	conn.Write(encodeFrame(FrameEncodeOptions{
+		r:             bytes.NewReader(payload),
+		payloadLength: uint64(len(payload)),
+		opCode:        opcode,
+		fin:           fin,
+		mask:          true,
+	}))
+}
+
+func TestReadMessage(t *testing.T) {
+	s, conn := newPipeSocket()
+	s.applyOptions(SocketOptions{PullMessages: true})
+	go s.Run()
+
+	go writeClientFrame(conn, OPCODE_BINARY, []byte{1, 2, 3}, true)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	messageType, payload, err := s.ReadMessage(ctx)
+	if err != nil || messageType != MESSAGE_TYPE_BINARY || !bytes.Equal(payload, []byte{1, 2, 3}) {
+		t.Fatal("Unexpected message", messageType, payload, err)
+	}
+
+	// a rune split across fragments, with a ping in between
+	go func() {
+		writeClientFrame(conn, OPCODE_TEXT, []byte("h\xc3"), false)
+		writeClientFrame(conn, OPCODE_PING, []byte("ping"), true)
+		writeClientFrame(conn, OPCODE_CONTINUATION, []byte("\xa9llo"), true)
+	}()
+	messageType, r, err := s.NextReader(ctx)
+	if err != nil || messageType != MESSAGE_TYPE_TEXT {
+		t.Fatal("Unexpected message", messageType, err)
+	}
+	f, err := decodeFrame(decodeFrameSettings{reader: conn})
+	if err != nil || f.Opcode != OPCODE_PONG || string(f.Payload) != "ping" {
+		t.Fatal("Ping not answered before the reader is drained", err)
+	}
+	payload, err = io.ReadAll(r)
+	if err != nil || string(payload) != "h\xc3\xa9llo" {
+		t.Error("Unexpected streamed message", payload, err)
+	}
+}
+
+func TestReadMessageContext(t *testing.T) {
+	s, conn := newPipeSocket()
+	s.applyOptions(SocketOptions{PullMessages: true})
+	go s.Run()
+
+	go writeClientFrame(conn, OPCODE_BINARY, []byte{1}, false)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, _, err := s.ReadMessage(ctx); err != context.DeadlineExceeded {
+		t.Error("Unexpected error", err)
+	}
+}
+
+func TestUnrequestedMessage(t *testing.T) {
+	s, conn := newPipeSocket()
+	s.OnText(func(text string) {})
+	go s.Run()
+
+	// neither OnBinary nor PullMessages asked for binary messages
+	go func() {
+		writeClientFrame(conn, OPCODE_BINARY, []byte{1, 2, 3}, true)
+		writeClientFrame(conn, OPCODE_PING, []byte("ping"), true)
+	}()
+	f, err := decodeFrame(decodeFrameSettings{reader: conn})
+	if err != nil || f.Opcode != OPCODE_PONG {
+		t.Fatal("Ping not answered after an unrequested message", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, _, err := s.ReadMessage(ctx); err != ErrPullMessagesDisabled {
+		t.Error("Unexpected error", err)
+	}
+}
+
+func TestReadMessageInvalidUTF8(t *testing.T) {
+	s, conn := newPipeSocket()
+	s.applyOptions(SocketOptions{PullMessages: true})
+	go s.Run()
+
+	go writeClientFrame(conn, OPCODE_TEXT, []byte("h\xc3"), true)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, _, err := s.ReadMessage(ctx); err != ErrSocketNotOpen {
+		t.Error("Invalid message delivered", err)
+	}
+
+	f, err := decodeFrame(decodeFrameSettings{reader: conn})
+	if err != nil || f.Opcode != OPCODE_CLOSE {
+		t.Fatal("Close frame not sent", err)
+	}
+	if code, _ := parseClosePayload(f.Payload); code != CloseCodeInconsistentData {
+		t.Error("Unexpected close code", code)
+	}
+}
+
+func TestNextReaderContext(t *testing.T) {
+	s, _ := newPipeSocket()
+	s.applyOptions(SocketOptions{PullMessages: true})
+	go s.Run()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, _, err := s.NextReader(ctx); err != context.DeadlineExceeded {
+		t.Error("Unexpected error", err)
+	}
+}
+
+func TestStreamLastFragment(t *testing.T) {
+	s, conn := newPipeSocket()
+	streamed := make(chan string, 1)
+	s.OnStreamStart(func(t MessageType, r io.Reader) {
+		go func() {
+			payload, _ := io.ReadAll(r)
+			streamed <- string(payload)
+		}()
+	})
+	go s.Run()
+
+	go func() {
+		writeClientFrame(conn, OPCODE_BINARY, []byte("first "), false)
+		writeClientFrame(conn, OPCODE_CONTINUATION, []byte("last"), true)
+	}()
+	select {
+	case payload := <-streamed:
+		if payload != "first last" {
+			t.Error("Unexpected streamed message", payload)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Stream not closed")
+	}
+}
+
+func TestQueuedMessageKeepalive(t *testing.T) {
+	s, conn := newPipeSocket()
+	s.applyOptions(SocketOptions{
+		PullMessages: true,
+		PingInterval: 20 * time.Millisecond,
+		PongTimeout:  50 * time.Millisecond,
+	})
+	go s.Run()
+	defer s.Close()
+
+	// the peer answers every ping while the message waits for a reader
+	go func() {
+		writeClientFrame(conn, OPCODE_BINARY, []byte{1, 2, 3}, true)
+		for {
+			f, err := decodeFrame(decodeFrameSettings{reader: conn})
+			if err != nil {
+				return
+			}
+			if f.Opcode == OPCODE_CLOSE {
+				writeClientFrame(conn, OPCODE_CLOSE, f.Payload, true)
+				return
+			}
+			if f.Opcode == OPCODE_PING {
+				writeClientFrame(conn, OPCODE_PONG, f.Payload, true)
+			}
+		}
+	}()
+	time.Sleep(200 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, payload, err := s.ReadMessage(ctx)
+	if err != nil || !bytes.Equal(payload, []byte{1, 2, 3}) {
+		t.Error("Queued message lost", payload, err)
+	}
+	if s.Status() != SocketStatusOpen {
+		t.Error("Socket closed while the message was queued", s.Status())
+	}
+}
+
+func TestQueuedMessagesTooBig(t *testing.T) {
+	s, conn := newPipeSocket()
+	s.applyOptions(SocketOptions{PullMessages: true, MaxMessageSize: 8})
+	go s.Run()
+
+	go func() {
+		writeClientFrame(conn, OPCODE_TEXT, []byte("first"), true)
+		writeClientFrame(conn, OPCODE_TEXT, []byte("second"), true)
+	}()
+	f, err := decodeFrame(decodeFrameSettings{reader: conn})
+	if err != nil || f.Opcode != OPCODE_CLOSE {
+		t.Fatal("Close frame not sent", err)
+	}
+	if code, _ := parseClosePayload(f.Payload); code != CloseCodeMessageTooBig {
+		t.Error("Unexpected close code", code)
+	}
+}
@@ -0,0 +1,69 @@
+package ws
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+)
+
+// Request returns the upgrade request accepted by the server,
+// nil for client sockets
+func (s *socket) Request() *http.Request {
+	return s.request
+}
+
+// Path returns the path of the upgrade request
+func (s *socket) Path() string {
+	if s.request == nil {
+		return ""
+	}
+	return s.request.URL.Path
+}
+
+// Query returns the parsed query string of the upgrade request
+func (s *socket) Query() url.Values {
+	if s.request == nil {
+		return url.Values{}
+	}
+	return s.request.URL.Query()
+}
+
+// Header returns the headers of the upgrade request
+func (s *socket) Header() http.Header {
+	if s.request == nil {
+		return http.Header{}
+	}
+	return s.request.Header
+}
+
+// Cookie returns the named cookie of the upgrade request, or http.ErrNoCookie
+func (s *socket) Cookie(name string) (*http.Cookie, error) {
+	if s.request == nil {
+		return nil, http.ErrNoCookie
+	}
+	return s.request.Cookie(name)
+}
+
+// Cookies returns the cookies of the upgrade request
+func (s *socket) Cookies() []*http.Cookie {
+	if s.request == nil {
+		return nil
+	}
+	return s.request.Cookies()
+}
+
+// RemoteAddr returns the address of the peer, nil when the connection is not a net.Conn
+func (s *socket) RemoteAddr() net.Addr {
+	if conn, ok := s.rwc.(net.Conn); ok {
+		return conn.RemoteAddr()
+	}
+	return nil
+}
+
+// LocalAddr returns the local address of the connection, nil when it is not a net.Conn
+func (s *socket) LocalAddr() net.Addr {
+	if conn, ok := s.rwc.(net.Conn); ok {
+		return conn.LocalAddr()
+	}
+	return nil
+}
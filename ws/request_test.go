@@ -0,0 +1,91 @@
+package ws
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRequestMetadata(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServer()
+	defer srv.Close()
+	sockets := make(chan Socket, 1)
+	go srv.Serve(ln, func(err error, s Socket) {
+		if err == nil {
+			sockets <- s
+			go s.Run()
+		}
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	client, err := Dial(ctx, "ws://"+ln.Addr().String()+"/tenants/acme?token=secret", DialOptions{
+		Header: http.Header{"Cookie": {"session=42"}, "X-Tenant-Region": {"eu"}},
+	})
+	if err != nil {
+		t.Fatal("Unexpected dial error", err)
+	}
+	defer client.Close()
+
+	s := <-sockets
+	if s.Path() != "/tenants/acme" || s.Query().Get("token") != "secret" {
+		t.Error("Unexpected request line", s.Path(), s.Query())
+	}
+	if s.Header().Get("X-Tenant-Region") != "eu" {
+		t.Error("Unexpected headers", s.Header())
+	}
+	if cookie, err := s.Cookie("session"); err != nil || cookie.Value != "42" || len(s.Cookies()) != 1 {
+		t.Error("Unexpected cookies", s.Cookies(), err)
+	}
+	if _, err := s.Cookie("missing"); err != http.ErrNoCookie {
+		t.Error("Unexpected cookie error", err)
+	}
+	if s.LocalAddr().String() != ln.Addr().String() || s.RemoteAddr().String() != client.LocalAddr().String() {
+		t.Error("Unexpected addresses", s.LocalAddr(), s.RemoteAddr())
+	}
+	if s.Request().RemoteAddr != s.RemoteAddr().String() {
+		t.Error("Remote address not set on the request", s.Request().RemoteAddr)
+	}
+
+	if client.Request() != nil || client.Path() != "" || len(client.Query()) != 0 {
+		t.Error("Client socket exposes a request")
+	}
+}
+
+func TestUpgraderRequestMetadata(t *testing.T) {
+	sockets := make(chan Socket, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s, err := NewUpgrader().Upgrade(w, r)
+		if err != nil {
+			t.Error("Unexpected upgrade error", err)
+			return
+		}
+		sockets <- s
+		go s.Run()
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	client, err := Dial(ctx, "ws"+strings.TrimPrefix(srv.URL, "http")+"/rooms?name=lobby", DialOptions{})
+	if err != nil {
+		t.Fatal("Unexpected dial error", err)
+	}
+	defer client.Close()
+
+	s := <-sockets
+	if s.Path() != "/rooms" || s.Query().Get("name") != "lobby" {
+		t.Error("Unexpected request line", s.Path(), s.Query())
+	}
+	if s.RemoteAddr().String() != client.LocalAddr().String() {
+		t.Error("Unexpected remote address", s.RemoteAddr())
+	}
+}
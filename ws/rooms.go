@@ -0,0 +1,199 @@
+package ws
+
+import (
+	"sync"
+)
+
+// RoomHandler is notified when a socket joins or leaves a topic
+type RoomHandler func(topic string, s Socket)
+
+// Rooms delivers published messages to the sockets subscribed to a topic.
+// Each topic is backed by a Hub, sockets are unsubscribed from all their
+// topics once their connection is closed
+type Rooms struct {
+	options      HubOptions
+	mu           sync.Mutex
+	rooms        map[string]*Hub
+	members      map[uint64]*roomsMember
+	joinHandler  RoomHandler
+	leaveHandler RoomHandler
+}
+
+type roomsMember struct {
+	socket Socket
+	topics map[string]bool
+	left   chan struct{}
+}
+
+func NewRooms() *Rooms {
+	return NewRoomsWithOptions(HubOptions{})
+}
+
+func NewRoomsWithOptions(options HubOptions) *Rooms {
+	return &Rooms{
+		options: options,
+		rooms:   map[string]*Hub{},
+		members: map[uint64]*roomsMember{},
+	}
+}
+
+func (r *Rooms) OnJoin(h RoomHandler) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.joinHandler = h
+}
+
+func (r *Rooms) OnLeave(h RoomHandler) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.leaveHandler = h
+}
+
+// Subscribe adds the socket to topic, only open sockets can subscribe
+func (r *Rooms) Subscribe(s Socket, topic string) error {
+	if s.Status() != SocketStatusOpen {
+		return ErrSocketNotOpen
+	}
+
+	r.mu.Lock()
+	m, ok := r.members[s.ID()]
+	if !ok {
+		m = &roomsMember{
+			socket: s,
+			topics: map[string]bool{},
+			left:   make(chan struct{}),
+		}
+		r.members[s.ID()] = m
+		go r.watch(m)
+	}
+	if m.topics[topic] {
+		r.mu.Unlock()
+		return nil
+	}
+	m.topics[topic] = true
+
+	room, ok := r.rooms[topic]
+	if !ok {
+		room = NewHubWithOptions(r.options)
+		r.rooms[topic] = room
+	}
+	room.Join(s)
+	handler := r.joinHandler
+	r.mu.Unlock()
+
+	if handler != nil {
+		handler(topic, s)
+	}
+	return nil
+}
+
+func (r *Rooms) Unsubscribe(s Socket, topic string) {
+	r.mu.Lock()
+	left := r.unsubscribe(s, topic)
+	handler := r.leaveHandler
+	r.mu.Unlock()
+
+	if left && handler != nil {
+		handler(topic, s)
+	}
+}
+
+// unsubscribe must be called holding the lock, it returns whether the socket was subscribed
+func (r *Rooms) unsubscribe(s Socket, topic string) bool {
+	m, ok := r.members[s.ID()]
+	if !ok || !m.topics[topic] {
+		return false
+	}
+
+	delete(m.topics, topic)
+	if len(m.topics) == 0 {
+		delete(r.members, s.ID())
+		close(m.left)
+	}
+
+	room := r.rooms[topic]
+	room.Leave(s)
+	if room.Count() == 0 {
+		delete(r.rooms, topic)
+	}
+	return true
+}
+
+// watch unsubscribes a socket from all its topics once its connection is closed
+func (r *Rooms) watch(m *roomsMember) {
+	select {
+	case <-m.socket.Done():
+	case <-m.left:
+		return
+	}
+
+	r.mu.Lock()
+	var topics []string
+	for topic := range m.topics {
+		topics = append(topics, topic)
+	}
+	for _, topic := range topics {
+		r.unsubscribe(m.socket, topic)
+	}
+	handler := r.leaveHandler
+	r.mu.Unlock()
+
+	if handler != nil {
+		for _, topic := range topics {
+			handler(topic, m.socket)
+		}
+	}
+}
+
+// Publish broadcasts a message to the subscribers of topic,
+// see Hub.Broadcast for the error reporting
+func (r *Rooms) Publish(topic string, t MessageType, payload []byte) map[Socket]error {
+	r.mu.Lock()
+	room, ok := r.rooms[topic]
+	r.mu.Unlock()
+
+	if !ok {
+		return map[Socket]error{}
+	}
+	return room.Broadcast(t, payload)
+}
+
+// Members returns the sockets subscribed to topic
+func (r *Rooms) Members(topic string) []Socket {
+	r.mu.Lock()
+	room, ok := r.rooms[topic]
+	r.mu.Unlock()
+
+	if !ok {
+		return nil
+	}
+	return room.Members()
+}
+
+// Topics returns the topics the socket is subscribed to
+func (r *Rooms) Topics(s Socket) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	m, ok := r.members[s.ID()]
+	if !ok {
+		return nil
+	}
+	topics := make([]string, 0, len(m.topics))
+	for topic := range m.topics {
+		topics = append(topics, topic)
+	}
+	return topics
+}
+
+// Rooms returns the topics having at least one subscriber
+func (r *Rooms) Rooms() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	topics := make([]string, 0, len(r.rooms))
+	for topic := range r.rooms {
+		topics = append(topics, topic)
+	}
+	return topics
+}
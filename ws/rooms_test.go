@@ -0,0 +1,87 @@
+package ws
+
+import (
+	"io"
+	"sort"
+	"sync"
+	"testing"
+)
+
+func TestRooms(t *testing.T) {
+	rooms := NewRooms()
+
+	var mu sync.Mutex
+	events := map[string]int{}
+	rooms.OnJoin(func(topic string, s Socket) {
+		mu.Lock()
+		events["join "+topic]++
+		mu.Unlock()
+	})
+	rooms.OnLeave(func(topic string, s Socket) {
+		mu.Lock()
+		events["leave "+topic]++
+		mu.Unlock()
+	})
+
+	a, aConn := newPipeSocket()
+	b, bConn := newPipeSocket()
+	defer bConn.Close()
+
+	rooms.Subscribe(a, "chat")
+	rooms.Subscribe(a, "news")
+	rooms.Subscribe(b, "chat")
+
+	topics := rooms.Topics(a)
+	sort.Strings(topics)
+	if len(topics) != 2 || topics[0] != "chat" || topics[1] != "news" {
+		t.Error("Unexpected topics", topics)
+	}
+	if len(rooms.Members("chat")) != 2 || len(rooms.Members("news")) != 1 {
+		t.Error("Unexpected members")
+	}
+
+	received := make(chan string, 2)
+	for _, conn := range []io.Reader{aConn, bConn} {
+		go func(conn io.Reader) {
+			f, err := decodeFrame(decodeFrameSettings{reader: conn})
+			if err != nil {
+				t.Error("Unexpected read error", err)
+				return
+			}
+			received <- string(f.Payload)
+		}(conn)
+	}
+	if errs := rooms.Publish("chat", MESSAGE_TYPE_TEXT, []byte("hi all")); len(errs) != 0 {
+		t.Error("Unexpected publish errors", errs)
+	}
+	for i := 0; i < 2; i++ {
+		if text := <-received; text != "hi all" {
+			t.Error("Unexpected message", text)
+		}
+	}
+
+	// a disconnects and leaves all its rooms
+	a.closeConnection()
+	waitFor(t, func() bool { return len(rooms.Members("chat")) == 1 && len(rooms.Rooms()) == 1 })
+	waitFor(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return events["leave chat"] == 1 && events["leave news"] == 1
+	})
+
+	rooms.Unsubscribe(b, "chat")
+	if len(rooms.Rooms()) != 0 || len(rooms.Topics(b)) != 0 {
+		t.Error("Rooms not cleaned up", rooms.Rooms())
+	}
+
+	mu.Lock()
+	if events["join chat"] != 2 || events["join news"] != 1 || events["leave chat"] != 2 {
+		t.Error("Unexpected events", events)
+	}
+	mu.Unlock()
+
+	a.setStatus(SocketStatusClosed)
+	if err := rooms.Subscribe(a, "chat"); err != ErrSocketNotOpen {
+		t.Error("Closed socket subscribed", err)
+	}
+}
@@ -1,27 +1,81 @@
 package ws
 
 import (
-	"bufio"
+	"context"
 	"crypto/sha1"
+	"crypto/tls"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"net"
-	"strings"
+	"sync"
+	"time"
 )
 
 const ACCEPT_KEY_SUFFIX = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
 
+// WEBSOCKET_VERSION is the only Sec-WebSocket-Version supported
+const WEBSOCKET_VERSION = "13"
+
+// DefaultHandshakeTimeout bounds the handshakes when no timeout is configured
+const DefaultHandshakeTimeout = 10 * time.Second
+
+// DefaultMaxHeaderBytes bounds the upgrade requests when no limit is configured
+const DefaultMaxHeaderBytes = 1 << 20
+
+// AcceptHandler is called with every handshaken socket or error,
+// possibly from several goroutines at once
 type AcceptHandler func(error, Socket)
 type Server interface {
 	Listen(url string, handler AcceptHandler) error
+	ListenTLS(url string, config *tls.Config, handler AcceptHandler) error
+	Serve(ln net.Listener, handler AcceptHandler) error
+	Shutdown(ctx context.Context) (int, error)
 	Close() error
+	Sockets() []Socket
+	Socket(id uint64) (Socket, bool)
+	Count() int
+}
+
+type ServerOptions struct {
+	SocketOptions
+	// Subprotocols lists the supported subprotocols in order of preference
+	Subprotocols []string
+	// Extensions lists the supported extensions in order of preference
+	Extensions []Extension
+	// PerMessageDeflate accepts compression when clients offer it,
+	// it is preferred over Extensions
+	PerMessageDeflate *DeflateOptions
+	// ShutdownReason is sent along with the 1001 close code on Shutdown
+	ShutdownReason string
+	// CheckUpgrade may authenticate, reject or add response headers to upgrade requests
+	CheckUpgrade CheckUpgradeFunc
+	// OriginPolicy rejects browser requests from other origins with 403 Forbidden,
+	// nil allows every origin
+	OriginPolicy *OriginPolicy
+	// HandshakeTimeout bounds the TLS and upgrade handshakes of accepted connections,
+	// zero means DefaultHandshakeTimeout
+	HandshakeTimeout time.Duration
+	// MaxHeaderBytes bounds the size of upgrade requests, larger ones are answered
+	// with 431 Request Header Fields Too Large, zero means DefaultMaxHeaderBytes
+	MaxHeaderBytes int
+}
+
+func (o ServerOptions) maxHeaderBytes() int64 {
+	if o.MaxHeaderBytes <= 0 {
+		return DefaultMaxHeaderBytes
+	}
+	return int64(o.MaxHeaderBytes)
 }
 
 type server struct {
 	listener      net.Listener
 	acceptHandler AcceptHandler
 	quitCh        chan bool
-	isClosed	bool
+	isClosed      bool
+	options       ServerOptions
+	mu            sync.Mutex
+	sockets       map[uint64]*socket
 }
 
 func (s *server) Listen(url string, handler AcceptHandler) error {
@@ -29,51 +83,213 @@ func (s *server) Listen(url string, handler AcceptHandler) error {
 	if ln, err := net.Listen("tcp", url); err != nil {
 		return err
 	} else {
-		defer ln.Close()
-		s.listener = ln
-		s.acceptHandler = handler
-		s.acceptLoop()
+		return s.Serve(ln, handler)
 	}
+}
 
-	return nil
+// ListenTLS accepts wss:// connections.
+// The certificate is picked by the client SNI among config.Certificates,
+// or by config.GetCertificate when set
+func (s *server) ListenTLS(url string, config *tls.Config, handler AcceptHandler) error {
+
+	if ln, err := tls.Listen("tcp", url, config); err != nil {
+		return err
+	} else {
+		return s.Serve(ln, handler)
+	}
+}
+
+// Serve accepts connections on an existing listener, such as a unix socket
+// or a wrapped listener, until the server is closed.
+// The listener is closed when Serve returns. Serve returns nil once the server
+// is closed, or the listener error when it gets closed by someone else
+func (s *server) Serve(ln net.Listener, handler AcceptHandler) error {
+	defer ln.Close()
+
+	s.mu.Lock()
+	if s.isClosed {
+		s.mu.Unlock()
+		return ErrServerClosed
+	}
+	s.listener = ln
+	s.acceptHandler = handler
+	s.mu.Unlock()
+
+	return s.acceptLoop()
 }
 
 func (s *server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.isClosed {
+		return ErrServerClosed
+	}
 	s.isClosed = true
-	s.listener.Close()
+	if s.listener != nil {
+		s.listener.Close()
+	}
 	close(s.quitCh)
 	return nil
 }
 
-func (s *server) acceptLoop() {
-	
+// Shutdown stops accepting connections and starts the closing handshake
+// with a 1001 Going Away on every live socket.
+// It waits for the peers to reply or for ctx to expire, then forcibly closes
+// the remaining connections and returns how many of them there were, along
+// with the ctx error
+func (s *server) Shutdown(ctx context.Context) (int, error) {
+	s.mu.Lock()
+	if s.isClosed {
+		s.mu.Unlock()
+		return 0, ErrServerClosed
+	}
+	s.isClosed = true
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	sockets := make([]*socket, 0, len(s.sockets))
+	for _, c := range s.sockets {
+		sockets = append(sockets, c)
+	}
+	s.mu.Unlock()
+
+	reason := s.options.ShutdownReason
+	if validateClose(CloseCodeGoingAway, reason) != nil {
+		reason = ""
+	}
+	for _, c := range sockets {
+		c.startClosingHandshake(CloseCodeGoingAway, reason)
+	}
+
+	for _, c := range sockets {
+		select {
+		case <-c.Done():
+		case <-ctx.Done():
+		}
+	}
+
+	forced := 0
+	for _, c := range sockets {
+		select {
+		case <-c.Done():
+		default:
+			forced++
+			c.drop()
+		}
+	}
+	close(s.quitCh)
+
+	if forced > 0 {
+		return forced, ctx.Err()
+	}
+	return 0, nil
+}
+
+// track registers a live socket until its connection is closed,
+// which happens at the latest when its Run returns.
+// Sockets handshaken after the server was closed are refused
+func (s *server) track(c *socket) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.isClosed {
+		return false
+	}
+	if s.sockets == nil {
+		s.sockets = map[uint64]*socket{}
+	}
+	s.sockets[c.id] = c
+
+	go func() {
+		<-c.Done()
+		s.mu.Lock()
+		delete(s.sockets, c.id)
+		s.mu.Unlock()
+	}()
+	return true
+}
+
+// Sockets returns a snapshot of the live sockets
+func (s *server) Sockets() []Socket {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sockets := make([]Socket, 0, len(s.sockets))
+	for _, c := range s.sockets {
+		sockets = append(sockets, c)
+	}
+	return sockets
+}
+
+// Socket looks up a live socket by its ID
+func (s *server) Socket(id uint64) (Socket, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.sockets[id]
+	if !ok {
+		return nil, false
+	}
+	return c, true
+}
+
+// Count returns the number of live sockets
+func (s *server) Count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.sockets)
+}
+
+func (s *server) closed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.isClosed
+}
+
+func (s *server) acceptLoop() error {
+
 	for {
 		if conn, err := s.listener.Accept(); err != nil {
 			s.acceptHandler(err, nil)
-			if s.isClosed {
-				return
+			if s.closed() {
+				return nil
 			}
-		} else {
-
-			c := &socket{
-				rwc: conn,
-				frameHandler: func(messsageType byte, payload []byte, fin bool) {
-				},
-				serverQuit: s.quitCh,
-				status:     SocketStatusOpening,
-			}
-			err = c.handshake()
-			if err != nil {
-				fmt.Println(err)
-				conn.Close()
-				s.acceptHandler(err, nil)
-			} else {
-				s.acceptHandler(nil, c)
+			if errors.Is(err, net.ErrClosed) {
+				return err
 			}
+		} else {
+			go s.serveConn(conn)
 		}
 	}
 }
 
+// serveConn runs the handshake of an accepted connection, including the TLS one,
+// so that a slow or silent client does not hold up the other connections
+func (s *server) serveConn(conn net.Conn) {
+	timeout := s.options.HandshakeTimeout
+	if timeout <= 0 {
+		timeout = DefaultHandshakeTimeout
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	c := newSocket(conn, s.quitCh)
+	c.applyOptions(s.options.SocketOptions)
+	err := c.handshake(s.options)
+	if err == nil {
+		err = conn.SetDeadline(time.Time{})
+	}
+	if err != nil {
+		conn.Close()
+		s.acceptHandler(err, nil)
+	} else if !s.track(c) {
+		conn.Close()
+		s.acceptHandler(ErrServerClosed, nil)
+	} else {
+		s.acceptHandler(nil, c)
+	}
+}
+
 func generateWebsocketAccept(key string) string {
 	concatenation := fmt.Sprintf("%s%s", key, ACCEPT_KEY_SUFFIX)
 
@@ -84,25 +300,13 @@ func generateWebsocketAccept(key string) string {
 }
 
 func NewServer() Server {
-	return &server{
-		isClosed: false,
-	}
+	return NewServerWithOptions(ServerOptions{})
 }
 
-func scanHeaders(scanner *bufio.Scanner) map[string]string {
-	headers := map[string]string{}
-
-	for {
-		scanner.Scan()
-		line := scanner.Text()
-		if line == "" {
-			break
-		}
-
-		headerParts := strings.Split(line, ":")
-		headerKey := strings.ToLower(headerParts[0])
-		headerValue := strings.Trim(headerParts[1], " ")
-		headers[headerKey] = headerValue
+func NewServerWithOptions(options ServerOptions) Server {
+	return &server{
+		quitCh:   make(chan bool),
+		isClosed: false,
+		options:  options,
 	}
-	return headers
 }
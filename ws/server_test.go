@@ -1,9 +1,16 @@
 package ws
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
 	"errors"
 	"io"
 	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 )
@@ -67,3 +74,353 @@ func (tc testConnection) SetReadDeadline(t time.Time) error {
 func (tc testConnection) SetWriteDeadline(t time.Time) error {
 	return nil
 }
+
+func TestServeUnixSocket(t *testing.T) {
+	ln, err := net.Listen("unix", filepath.Join(t.TempDir(), "ws.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := NewServer()
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.Serve(ln, func(err error, s Socket) {
+			if err == nil {
+				go s.Run()
+			}
+		})
+	}()
+
+	conn, err := net.Dial("unix", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	br := rawHandshake(t, conn)
+
+	payloadReader := bytes.NewReader([]byte("hello"))
+	conn.Write(encodeFrame(FrameEncodeOptions{
+		r:             payloadReader,
+		payloadLength: uint64(payloadReader.Len()),
+		opCode:        OPCODE_PING,
+		fin:           true,
+		mask:          true,
+	}))
+	frame, err := decodeFrame(decodeFrameSettings{reader: br})
+	if err != nil || frame.Opcode != OPCODE_PONG {
+		t.Error("Ping not answered", err)
+	}
+
+	if err := srv.Close(); err != nil {
+		t.Error("Unexpected close error", err)
+	}
+	if err := <-served; err != nil {
+		t.Error("Unexpected serve error", err)
+	}
+	if err := srv.Close(); err != ErrServerClosed {
+		t.Error("Server closed twice", err)
+	}
+}
+
+func TestServeAfterClose(t *testing.T) {
+	srv := NewServer()
+	srv.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Serve(ln, func(error, Socket) {}); err != ErrServerClosed {
+		t.Error("Unexpected serve error", err)
+	}
+	if _, err := ln.Accept(); err == nil {
+		t.Error("Listener not closed")
+	}
+}
+
+// rawHandshake upgrades conn by hand and returns the reader to decode frames from
+func rawHandshake(t *testing.T, conn net.Conn) *bufio.Reader {
+	conn.Write([]byte(strings.Join([]string{
+		"GET / HTTP/1.1",
+		"Host: localhost",
+		"Connection: Upgrade",
+		"Upgrade: websocket",
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==",
+		"Sec-WebSocket-Version: 13",
+		"\r\n",
+	}, "\r\n")))
+
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatal("Unexpected status code", res.StatusCode)
+	}
+	if res.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Error("Unexpected accept key", res.Header.Get("Sec-WebSocket-Accept"))
+	}
+	return br
+}
+
+func startTestServer(t *testing.T, options ServerOptions) (Server, string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServerWithOptions(options)
+	go srv.Serve(ln, func(err error, s Socket) {
+		if err == nil {
+			go s.Run()
+		}
+	})
+	return srv, ln.Addr().String()
+}
+
+func TestShutdown(t *testing.T) {
+	srv, addr := startTestServer(t, ServerOptions{ShutdownReason: "maintenance"})
+
+	s, err := Dial(context.Background(), "ws://"+addr, DialOptions{})
+	if err != nil {
+		t.Fatal("Unexpected dial error", err)
+	}
+	go s.Run()
+
+	// a peer never answering the closing handshake
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	br := rawHandshake(t, conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	forced, err := srv.Shutdown(ctx)
+	if forced != 1 || err != context.DeadlineExceeded {
+		t.Error("Unexpected shutdown result", forced, err)
+	}
+
+	select {
+	case <-s.Done():
+	case <-time.After(time.Second):
+		t.Error("Client socket not closed")
+	}
+
+	frame, err := decodeFrame(decodeFrameSettings{reader: br})
+	if err != nil {
+		t.Fatal("Unexpected error while decoding frame", err)
+	}
+	if frame.Opcode != OPCODE_CLOSE || binary.BigEndian.Uint16(frame.Payload) != CloseCodeGoingAway || string(frame.Payload[2:]) != "maintenance" {
+		t.Error("Unexpected close frame", frame.Opcode, frame.Payload)
+	}
+
+	if _, err := srv.Shutdown(context.Background()); err != ErrServerClosed {
+		t.Error("Server shut down twice", err)
+	}
+}
+
+// waitFor polls cond until it holds or a second elapsed
+func waitFor(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("Condition not met in time")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	srv, addr := startTestServer(t, ServerOptions{})
+	defer srv.Close()
+
+	var clients []Socket
+	for i := 0; i < 2; i++ {
+		s, err := Dial(context.Background(), "ws://"+addr, DialOptions{})
+		if err != nil {
+			t.Fatal("Unexpected dial error", err)
+		}
+		go s.Run()
+		clients = append(clients, s)
+	}
+	waitFor(t, func() bool { return srv.Count() == 2 })
+
+	sockets := srv.Sockets()
+	if len(sockets) != 2 || sockets[0].ID() == sockets[1].ID() {
+		t.Fatal("Unexpected registered sockets", sockets)
+	}
+	if s, ok := srv.Socket(sockets[1].ID()); !ok || s != sockets[1] {
+		t.Error("Socket lookup failed")
+	}
+
+	clients[0].Close()
+	waitFor(t, func() bool { return srv.Count() == 1 })
+	if _, ok := srv.Socket(0); ok {
+		t.Error("Unexpected socket found")
+	}
+	clients[1].Close()
+	waitFor(t, func() bool { return srv.Count() == 0 })
+}
+
+func TestHandshakeValidation(t *testing.T) {
+	srv, addr := startTestServer(t, ServerOptions{})
+	defer srv.Close()
+
+	valid := map[string]string{
+		"Host":                  "example.com:9000",
+		"Connection":            "keep-alive, Upgrade",
+		"Upgrade":               "websocket",
+		"Sec-WebSocket-Key":     "dGhlIHNhbXBsZSBub25jZQ==",
+		"Sec-WebSocket-Version": "13",
+	}
+	cases := []struct {
+		name        string
+		requestLine string
+		header      map[string]string
+		extraLine   string
+		status      int
+	}{
+		{"firefox connection tokens", "GET / HTTP/1.1", nil, "", http.StatusSwitchingProtocols},
+		{"post", "POST / HTTP/1.1", nil, "", http.StatusMethodNotAllowed},
+		{"http 1.0", "GET / HTTP/1.0", nil, "", http.StatusBadRequest},
+		{"missing host", "GET / HTTP/1.1", map[string]string{"Host": ""}, "", http.StatusBadRequest},
+		{"old version", "GET / HTTP/1.1", map[string]string{"Sec-WebSocket-Version": "8"}, "", http.StatusUpgradeRequired},
+		{"short key", "GET / HTTP/1.1", map[string]string{"Sec-WebSocket-Key": "c2hvcnQ="}, "", http.StatusBadRequest},
+		{"duplicate key", "GET / HTTP/1.1", nil, "Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==", http.StatusBadRequest},
+		{"missing upgrade token", "GET / HTTP/1.1", map[string]string{"Connection": "keep-alive"}, "", http.StatusUpgradeRequired},
+		{"malformed header", "GET / HTTP/1.1", nil, "no colon here", http.StatusBadRequest},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			lines := []string{c.requestLine}
+			for name, value := range valid {
+				if override, ok := c.header[name]; ok {
+					value = override
+				}
+				if value != "" {
+					lines = append(lines, name+": "+value)
+				}
+			}
+			if c.extraLine != "" {
+				lines = append(lines, c.extraLine)
+			}
+			lines = append(lines, "\r\n")
+
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.Write([]byte(strings.Join(lines, "\r\n")))
+
+			res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+			if res.StatusCode != c.status {
+				t.Error("Unexpected status code", res.StatusCode)
+			}
+			if c.status == http.StatusUpgradeRequired && c.header["Sec-WebSocket-Version"] != "" &&
+				res.Header.Get("Sec-WebSocket-Version") != WEBSOCKET_VERSION {
+				t.Error("Supported versions not advertised", res.Header)
+			}
+		})
+	}
+}
+
+func TestHandshakeTooLarge(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	c := newSocket(serverConn, nil)
+	handshaken := make(chan error, 1)
+	go func() {
+		handshaken <- c.handshake(ServerOptions{MaxHeaderBytes: 1024})
+	}()
+
+	// the header never ends
+	go func() {
+		clientConn.Write([]byte("GET / HTTP/1.1\r\nHost: localhost\r\nX-Padding: "))
+		clientConn.Write(bytes.Repeat([]byte("a"), 4096))
+	}()
+
+	res, err := http.ReadResponse(bufio.NewReader(clientConn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusRequestHeaderFieldsTooLarge {
+		t.Error("Unexpected status code", res.StatusCode)
+	}
+	if err := <-handshaken; err != ErrHandshakeTooLarge {
+		t.Error("Unexpected handshake error", err)
+	}
+}
+
+func TestPipelinedFrames(t *testing.T) {
+	_, addr := startTestServer(t, ServerOptions{})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// the request and a ping are sent in a single write
+	request := strings.Join([]string{
+		"GET / HTTP/1.1",
+		"Host: localhost",
+		"Connection: Upgrade",
+		"Upgrade: websocket",
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==",
+		"Sec-WebSocket-Version: 13",
+		"\r\n",
+	}, "\r\n")
+	ping := encodeFrame(FrameEncodeOptions{
+		r:             bytes.NewReader([]byte("early")),
+		payloadLength: 5,
+		opCode:        OPCODE_PING,
+		fin:           true,
+		mask:          true,
+	})
+	conn.Write(append([]byte(request), ping...))
+
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, nil)
+	if err != nil || res.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatal("Handshake failed", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	f, err := decodeFrame(decodeFrameSettings{reader: br})
+	if err != nil || f.Opcode != OPCODE_PONG || string(f.Payload) != "early" {
+		t.Error("Early ping lost", err)
+	}
+}
+
+func TestSilentClientDoesNotBlockAccept(t *testing.T) {
+	srv, addr := startTestServer(t, ServerOptions{HandshakeTimeout: 100 * time.Millisecond})
+	defer srv.Close()
+
+	silent, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	s, err := Dial(ctx, "ws://"+addr, DialOptions{})
+	if err != nil {
+		t.Fatal("Dial blocked by a silent client", err)
+	}
+	s.Close()
+
+	silent.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := silent.Read(make([]byte, 1)); err != io.EOF {
+		t.Error("Silent client not dropped after the handshake timeout", err)
+	}
+}
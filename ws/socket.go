@@ -3,12 +3,24 @@ package ws
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
-	"math/rand"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"runtime"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 	"unicode/utf8"
 )
 
@@ -17,9 +29,36 @@ type Socket interface {
 	OnText(h TextHandler)
 	OnBinary(h BinaryHandler)
 	OnStreamStart(h StreamStartHandler)
-	SendMessage(messageType byte, r io.Reader)
+	SendMessage(t MessageType, r io.Reader) error
+	NextWriter(t MessageType) io.WriteCloser
+	SetMaxFrameSize(size int)
 	Close() error
 	Status() int
+	Subprotocol() string
+	Extensions() []ExtensionParams
+	TLSConnectionState() (tls.ConnectionState, bool)
+	Done() <-chan struct{}
+	ID() uint64
+	WritePreparedMessage(pm *PreparedMessage) error
+	SetWriteDeadline(t time.Time) error
+	Ping(payload []byte) error
+	OnPong(h PongHandler)
+	RTT() time.Duration
+	OnClose(h CloseHandler)
+	CloseWithCode(code uint16, reason string) error
+	OnStateChange(StateChangeHandler)
+	UpgradeResponse() *UpgradeResponse
+	Request() *http.Request
+	Path() string
+	Query() url.Values
+	Header() http.Header
+	Cookie(name string) (*http.Cookie, error)
+	Cookies() []*http.Cookie
+	RemoteAddr() net.Addr
+	LocalAddr() net.Addr
+	NextReader(ctx context.Context) (MessageType, io.Reader, error)
+	ReadMessage(ctx context.Context) (MessageType, []byte, error)
+	SetReadLimits(maxFramePayloadSize int64, maxMessageSize int64)
 }
 
 type MessageType byte
@@ -27,6 +66,37 @@ type FrameHandler func(byte, []byte, bool)
 type TextHandler func(text string)
 type BinaryHandler func(data []byte)
 type StreamStartHandler func(t MessageType, r io.Reader)
+type PongHandler func(payload []byte)
+
+// CloseHandler is called once the connection is closed, with the code and reason
+// of the close frame that started the closing handshake.
+// remote reports whether the peer started it. CloseCodeNoStatus is given when the peer
+// sent no code and CloseCodeAbnormalClosure when the connection dropped without close frame
+type CloseHandler func(code uint16, reason string, remote bool)
+
+// SocketOptions holds the settings shared by server and client sockets
+type SocketOptions struct {
+	// MaxFrameSize is the payload size above which outgoing messages are fragmented,
+	// zero means DefaultMaxFrameSize
+	MaxFrameSize int
+	// PingInterval enables automatic pings, zero disables them
+	PingInterval time.Duration
+	// PongTimeout is how long to wait for the pong of an automatic ping before
+	// dropping the connection, zero disables the check
+	PongTimeout time.Duration
+	// CloseTimeout bounds the wait for the peer reply to our close frame,
+	// zero means DefaultCloseTimeout
+	CloseTimeout time.Duration
+	// MaxFramePayloadSize limits the payload of incoming frames,
+	// zero means DefaultMaxMessageSize and a negative value disables the limit
+	MaxFramePayloadSize int64
+	// MaxMessageSize limits incoming messages, including streamed and decompressed ones,
+	// zero means DefaultMaxMessageSize and a negative value disables the limit
+	MaxMessageSize int64
+	// PullMessages hands the messages that no handler consumes to NextReader
+	// and ReadMessage, they are discarded otherwise
+	PullMessages bool
+}
 
 const (
 	OPCODE_CONTINUATION = 0x0
@@ -47,8 +117,14 @@ const (
 	CloseCodeMessageTooBig        = uint16(1009)
 	CloseCodeUnsupportedExtension = uint16(1010)
 	CloseCodeUnexpectedCondition  = uint16(1011)
+	// the following codes are never sent on the wire
+	CloseCodeNoStatus        = uint16(1005)
+	CloseCodeAbnormalClosure = uint16(1006)
 )
 
+// MaxCloseReasonLength leaves room for the close code in a 125 bytes control frame
+const MaxCloseReasonLength = 123
+
 var validCloseCodes map[uint16]bool = map[uint16]bool{
 	CloseCodeNormal:               true,
 	CloseCodeGoingAway:            true,
@@ -61,11 +137,27 @@ var validCloseCodes map[uint16]bool = map[uint16]bool{
 	CloseCodeUnexpectedCondition:  true,
 }
 
+const (
+	RSV1 = 0x40
+	RSV2 = 0x20
+	RSV3 = 0x10
+)
+
 const (
 	MESSAGE_TYPE_TEXT   = OPCODE_TEXT
 	MESSAGE_TYPE_BINARY = OPCODE_BINARY
 )
 
+// DefaultMaxFrameSize is the payload size above which outgoing messages are
+// split into continuation frames
+const DefaultMaxFrameSize = 32 * 1024
+
+// DefaultCloseTimeout bounds the wait for the peer reply to our close frame
+const DefaultCloseTimeout = 5 * time.Second
+
+// DefaultMaxMessageSize limits incoming messages, and their frames, when no limit is configured
+const DefaultMaxMessageSize = 32 * 1024 * 1024
+
 const (
 	SocketStatusOpening = 1
 	SocketStatusOpen    = 2
@@ -73,7 +165,11 @@ const (
 	SocketStatusClosed  = 4
 )
 
+// lastSocketID is incremented to give every socket a unique ID
+var lastSocketID uint64
+
 type socket struct {
+	id                              uint64
 	rwc                             io.ReadWriteCloser
 	frameHandler                    FrameHandler
 	textHandler                     TextHandler
@@ -84,6 +180,57 @@ type socket struct {
 	danglingUTF8Bytes               []byte
 	serverQuit                      chan bool
 	status                          int
+	maxFrameSize                    int
+	isClient                        bool
+	subprotocol                     string
+	extensions                      []ExtensionCodec
+	extensionParams                 []ExtensionParams
+	transformedMessage              bool
+	transformedOpcode               byte
+	transformedRSV                  byte
+	transformedPayload              []byte
+	done                            chan struct{}
+	doneOnce                        sync.Once
+	pingInterval                    time.Duration
+	pongTimeout                     time.Duration
+	pongHandler                     PongHandler
+	pongCh                          chan struct{}
+	keepaliveMu                     sync.Mutex
+	pingPayload                     []byte
+	pingSentAt                      time.Time
+	rtt                             int64
+	closeHandler                    CloseHandler
+	closeMu                         sync.Mutex
+	closeRecorded                   bool
+	closeCode                       uint16
+	closeReason                     string
+	closeRemote                     bool
+	closeTimeout                    time.Duration
+	readOnce                        sync.Once
+	readDone                        chan struct{}
+	maxFramePayloadSize             int64
+	maxMessageSize                  int64
+	messageReceived                 uint64
+	// messageMu keeps the frames of a data message together,
+	// writeMu guards each write so control frames can go in between
+	messageMu          sync.Mutex
+	writeMu            sync.Mutex
+	stateMu            sync.Mutex
+	stateChangeHandler StateChangeHandler
+	// closing is closed once the socket stops being open
+	closing      chan struct{}
+	incoming     *pullQueue
+	pullMessages bool
+	// br is shared by the handshake and the frame decoding,
+	// so that frames sent right after the handshake are not lost
+	br              *bufio.Reader
+	request         *http.Request
+	upgradeResponse *UpgradeResponse
+	// readLoopGoroutine identifies the goroutine running the read loop and its handlers
+	readLoopGoroutine uint64
+	// closeTimer drops the connection when the peer does not reply to a close
+	// frame sent from a handler, it is only used by the read loop
+	closeTimer *time.Timer
 }
 
 type frame struct {
@@ -94,133 +241,579 @@ type frame struct {
 	DanglingUTF8Bytes []byte
 }
 
+func (f *frame) rsv() byte {
+	rsv := byte(0)
+	for i, bit := range []byte{RSV1, RSV2, RSV3} {
+		if f.Rsvs[i] {
+			rsv |= bit
+		}
+	}
+	return rsv
+}
+
+func newSocket(rwc io.ReadWriteCloser, serverQuit chan bool) *socket {
+	return &socket{
+		id:         atomic.AddUint64(&lastSocketID, 1),
+		rwc:        rwc,
+		serverQuit: serverQuit,
+		status:     SocketStatusOpening,
+		done:       make(chan struct{}),
+		pongCh:     make(chan struct{}, 1),
+		readDone:   make(chan struct{}),
+		closing:    make(chan struct{}),
+		incoming:   newPullQueue(),
+	}
+}
+
+func (s *socket) applyOptions(options SocketOptions) {
+	s.maxFrameSize = options.MaxFrameSize
+	s.pingInterval = options.PingInterval
+	s.pongTimeout = options.PongTimeout
+	s.closeTimeout = options.CloseTimeout
+	s.pullMessages = options.PullMessages
+	s.SetReadLimits(options.MaxFramePayloadSize, options.MaxMessageSize)
+}
+
+// SetReadLimits overrides the frame payload and message size limits of the socket,
+// zero restores DefaultMaxMessageSize and a negative value disables the limit.
+// Peers exceeding them are disconnected with CloseCodeMessageTooBig
+func (s *socket) SetReadLimits(maxFramePayloadSize int64, maxMessageSize int64) {
+	s.maxFramePayloadSize = maxFramePayloadSize
+	s.maxMessageSize = maxMessageSize
+	for _, extension := range s.extensions {
+		if codec, ok := extension.(interface{ setReadLimit(uint64) }); ok {
+			codec.setReadLimit(s.messageLimit())
+		}
+	}
+}
+
+// frameLimit and messageLimit resolve the configured limits, zero meaning no limit
+func (s *socket) frameLimit() uint64 {
+	return resolveReadLimit(s.maxFramePayloadSize)
+}
+
+func (s *socket) messageLimit() uint64 {
+	return resolveReadLimit(s.maxMessageSize)
+}
+
+func resolveReadLimit(limit int64) uint64 {
+	switch {
+	case limit == 0:
+		return DefaultMaxMessageSize
+	case limit < 0:
+		return 0
+	}
+	return uint64(limit)
+}
+
 func (s *socket) Run() {
-	go func() {
-		<-s.serverQuit
-		s.Close()
-		return
-	}()
-	s.readLoop()
+	if s.serverQuit != nil {
+		go func() {
+			select {
+			case <-s.serverQuit:
+				s.Close()
+			case <-s.done:
+			}
+		}()
+	}
+	if s.pingInterval > 0 {
+		go s.keepalive()
+	}
+	s.startReading()
+	<-s.readDone
 	s.Close()
 }
 
+// startReading runs the read loop once, either for Run or, when the socket
+// is closed without running, to drain the frames preceding the peer close reply
+func (s *socket) startReading() {
+	s.readOnce.Do(func() {
+		go func() {
+			atomic.StoreUint64(&s.readLoopGoroutine, goroutineID())
+			s.readLoop()
+			if s.closeTimer != nil {
+				// the reply was received or the connection failed, Run closes it
+				s.closeTimer.Stop()
+			}
+			close(s.readDone)
+		}()
+	})
+}
+
 func (s *socket) readLoop() {
 	for {
 		f, err := s.readFrame()
 
 		if err != nil {
-			fmt.Println("err1", err.Error())
-			switch err {
-			case io.EOF:
-				// connection dropped, nothing we can do here
-				s.status = SocketStatusClosed
-			case ErrInvalidUTF8:
-				s.sendCloseWithCode(CloseCodeInconsistentData)
-				s.status = SocketStatusClosing
-			default:
-				s.sendCloseWithCode(CloseCodeProtocolError)
-				s.status = SocketStatusClosing
-			}
+			s.handleReadError(err)
 			return
 		}
-		fmt.Printf("RX Fin=%t Opcode=%d Len=%d\n", f.Fin, f.Opcode, len(f.Payload))
 
-		switch f.Opcode {
-		case byte(OPCODE_TEXT):
-			s.frameHandler(f.Opcode, f.Payload, f.Fin)
-			if f.Fin && s.textHandler != nil {
-				s.textHandler(string(f.Payload))
+		if f.Opcode == OPCODE_CONTINUATION {
+			s.messageReceived += uint64(len(f.Payload))
+		} else if !isControlFrame(f.Opcode) {
+			s.messageReceived = uint64(len(f.Payload))
+		}
+
+		if s.Status() == SocketStatusClosing && f.Opcode != OPCODE_CLOSE {
+			s.discardFrame(f)
+			continue
+		}
+
+		if !isControlFrame(f.Opcode) && (f.rsv() != 0 || s.transformedMessage) {
+			if err := s.readTransformedFrame(f); err != nil {
+				s.handleReadError(err)
+				return
 			}
-		case byte(OPCODE_BINARY):
-			s.frameHandler(f.Opcode, f.Payload, f.Fin)
-			if f.Fin && s.binaryHandler != nil {
-				s.binaryHandler(f.Payload)
+			continue
+		}
+
+		switch f.Opcode {
+		case byte(OPCODE_TEXT), byte(OPCODE_BINARY):
+			s.dispatchFrame(f.Opcode, f.Payload, f.Fin)
+			s.streamWriter = s.startMessage(MessageType(f.Opcode), f.Fin)
+			if err := s.readDataFrame(f); err != nil {
+				s.handleReadError(err)
+				return
 			}
 		case byte(OPCODE_CONTINUATION):
-			s.frameHandler(f.Opcode, f.Payload, f.Fin)
+			s.dispatchFrame(f.Opcode, f.Payload, f.Fin)
+			if err := s.readDataFrame(f); err != nil {
+				s.handleReadError(err)
+				return
+			}
 		case byte(OPCODE_PING):
 			s.sendPong(f.Payload)
+		case byte(OPCODE_PONG):
+			s.receivePong(f.Payload)
 		case byte(OPCODE_CLOSE):
-			if s.status != SocketStatusClosing {
+			s.finishMessage(ErrSocketNotOpen)
+			// leaving Open first keeps data frames from following our reply
+			if s.setStatusFrom(SocketStatusClosing, SocketStatusOpening, SocketStatusOpen) {
+				code, reason := parseClosePayload(f.Payload)
+				s.recordClose(code, reason, true)
 				s.sendClose(ensureValidCloseCode(f.Payload))
-				s.status = SocketStatusClosed
 			}
+			s.setStatus(SocketStatusClosed)
 		}
 
 		if f.Opcode == byte(OPCODE_CLOSE) {
 			return
 		}
+	}
+}
+
+// readDataFrame writes the payload of a data frame to the current message writer
+// and keeps track of the fragmentation of the message.
+// Only the queued messages of NextReader fail the connection, with ErrMessageTooBig
+func (s *socket) readDataFrame(f *frame) error {
+	if _, err := s.streamWriter.Write(f.Payload); err == ErrMessageTooBig {
+		return err
+	}
+	if f.Fin {
+		s.finishMessage(nil)
+		s.expectedContinuationMessageType = 0
+		s.danglingUTF8Bytes = nil
+		return nil
+	}
+	if f.Opcode != OPCODE_CONTINUATION {
+		s.expectedContinuationMessageType = f.Opcode
+	}
+	s.danglingUTF8Bytes = f.DanglingUTF8Bytes
+	return nil
+}
+
+// discardFrame skips a frame received after our close frame was sent,
+// only keeping track of fragmentation so that the next frames can be decoded
+func (s *socket) discardFrame(f *frame) {
+	s.finishMessage(ErrSocketNotOpen)
+	s.danglingUTF8Bytes = nil
+	if isControlFrame(f.Opcode) {
+		return
+	}
+	if f.Opcode != OPCODE_CONTINUATION {
+		s.transformedMessage = f.rsv() != 0
+		s.expectedContinuationMessageType = f.Opcode
+	}
+	if f.Fin {
+		s.transformedMessage = false
+		s.transformedPayload = nil
+		s.expectedContinuationMessageType = 0
+	}
+}
+
+func (s *socket) handleReadError(err error) {
+	if err == io.EOF {
+		s.finishMessage(io.ErrUnexpectedEOF)
+	} else {
+		s.finishMessage(err)
+	}
+	if err == io.EOF {
+		// connection dropped, nothing we can do here
+		s.recordClose(CloseCodeAbnormalClosure, "", true)
+		s.setStatus(SocketStatusClosed)
+		return
+	}
+	if !s.setStatusFrom(SocketStatusClosing, SocketStatusOpening, SocketStatusOpen) {
+		// our close frame is already sent, the connection just needs to be closed
+		s.setStatus(SocketStatusClosed)
+		return
+	}
+
+	code := uint16(CloseCodeProtocolError)
+	switch err {
+	case ErrInvalidUTF8, ErrInvalidCompressedData:
+		code = CloseCodeInconsistentData
+	case ErrFrameTooBig, ErrMessageTooBig:
+		code = CloseCodeMessageTooBig
+	}
+	s.recordClose(code, "", false)
+	s.sendCloseWithCode(code)
+}
+
+// readTransformedFrame collects the frames of a message with extension RSV bits,
+// the message is decoded by the extensions and dispatched once the last fragment is received
+func (s *socket) readTransformedFrame(f *frame) error {
+	if f.Opcode != OPCODE_CONTINUATION {
+		s.transformedMessage = true
+		s.transformedOpcode = f.Opcode
+		s.transformedRSV = f.rsv()
+	}
+	s.transformedPayload = append(s.transformedPayload, f.Payload...)
+
+	if !f.Fin {
+		s.expectedContinuationMessageType = s.transformedOpcode
+		return nil
+	}
+
+	payload := s.transformedPayload
+	s.transformedMessage = false
+	s.transformedPayload = nil
+	s.expectedContinuationMessageType = 0
+
+	for i := len(s.extensions) - 1; i >= 0; i-- {
+		var err error
+		payload, err = s.extensions[i].Decode(s.transformedOpcode, s.transformedRSV, payload)
+		if err != nil {
+			return err
+		}
+	}
+	if limit := s.messageLimit(); limit > 0 && uint64(len(payload)) > limit {
+		return ErrMessageTooBig
+	}
 
-		if f.Fin && f.Opcode == OPCODE_CONTINUATION {
-			s.streamWriter.Close()
-			s.streamWriter = nil
-			s.expectedContinuationMessageType = 0
+	if s.transformedOpcode == OPCODE_TEXT && !utf8.Valid(payload) {
+		return ErrInvalidUTF8
+	}
+	s.dispatchFrame(s.transformedOpcode, payload, true)
+	s.streamWriter = s.startMessage(MessageType(s.transformedOpcode), true)
+	if _, err := s.streamWriter.Write(payload); err == ErrMessageTooBig {
+		return err
+	}
+	s.finishMessage(nil)
+	return nil
+}
+
+// encodeMessage applies the negotiated extensions to an outgoing message
+func (s *socket) encodeMessage(opcode byte, payload []byte) ([]byte, byte, error) {
+	rsv := byte(0)
+	for _, extension := range s.extensions {
+		var bits byte
+		var err error
+		payload, bits, err = extension.Encode(opcode, payload)
+		if err != nil {
+			return nil, 0, err
 		}
+		rsv |= bits
+	}
+	return payload, rsv, nil
+}
+
+func (s *socket) Close() error {
+	return s.CloseWithCode(CloseCodeGoingAway, "")
+}
+
+// CloseWithCode closes the socket with a custom close code and reason.
+// The code must be a valid RFC 6455 code or an application code in the 3000-4999 range,
+// the reason must be valid UTF-8 of at most MaxCloseReasonLength bytes.
+// Called from a handler, it returns once the close frame is sent
+// and the connection is closed when the peer replies, or after the close timeout
+func (s *socket) CloseWithCode(code uint16, reason string) error {
+	if err := validateClose(code, reason); err != nil {
+		return err
+	}
 
-		if !f.Fin {
-			if f.Opcode != OPCODE_CONTINUATION {
-				s.expectedContinuationMessageType = f.Opcode
-				if s.streamStartHandler != nil {
-					r, w := io.Pipe()
-					s.streamWriter = w
-					s.streamStartHandler(MessageType(f.Opcode), r)
-				} else {
-					s.streamWriter = WriterNopCloser{io.Discard}
-				}
+	for s.Status() != SocketStatusClosed {
+		if s.Status() == SocketStatusClosing {
+			if s.onReadLoop() {
+				// called from a handler, the read loop receives the reply once
+				// the handler returns and Run then closes the connection
+				return nil
+			}
+			s.waitCloseReply()
+			s.setStatus(SocketStatusClosed)
+			continue
+		}
+		// only one of concurrent callers sends the close frame
+		if s.setStatusFrom(SocketStatusClosing, SocketStatusOpening, SocketStatusOpen) {
+			s.recordClose(code, reason, false)
+			if err := s.sendClose(closePayload(code, reason)); err != nil {
+				// no reply can be expected if our close frame did not get through
+				s.setStatus(SocketStatusClosed)
+			} else if s.onReadLoop() {
+				s.closeTimer = time.AfterFunc(s.closeTimeoutOrDefault(), s.drop)
 			}
-			s.streamWriter.Write(f.Payload)
 		}
 	}
+	return s.closeConnection()
 }
 
-func (s *socket) Close() error {
+// waitCloseReply waits for the read loop to receive the peer close frame,
+// discarding any other frame, or for the close timeout to expire.
+// The read loop also ends when we failed the connection on a protocol error,
+// in which case the TCP connection is closed right away as RFC 6455 allows
+func (s *socket) waitCloseReply() {
+	s.startReading()
+
+	timer := time.NewTimer(s.closeTimeoutOrDefault())
+	defer timer.Stop()
+
+	select {
+	case <-s.readDone:
+	case <-timer.C:
+	}
+}
+
+func (s *socket) closeTimeoutOrDefault() time.Duration {
+	if s.closeTimeout <= 0 {
+		return DefaultCloseTimeout
+	}
+	return s.closeTimeout
+}
+
+// onReadLoop reports whether the caller runs on the read loop, that is in a handler
+func (s *socket) onReadLoop() bool {
+	id := atomic.LoadUint64(&s.readLoopGoroutine)
+	return id != 0 && id == goroutineID()
+}
+
+// goroutineID parses the ID of the calling goroutine from its stack header,
+// "goroutine 42 [running]:", Go offers no other way to identify it
+func goroutineID() uint64 {
+	buf := make([]byte, 64)
+	buf = bytes.TrimPrefix(buf[:runtime.Stack(buf, false)], []byte("goroutine "))
+	if i := bytes.IndexByte(buf, ' '); i > 0 {
+		buf = buf[:i]
+	}
+	id, _ := strconv.ParseUint(string(buf), 10, 64)
+	return id
+}
+
+// drop closes the connection without closing handshake
+func (s *socket) drop() {
+	s.setStatus(SocketStatusClosed)
+	s.closeConnection()
+}
+
+// closeConnection closes the underlying connection and signals Done
+func (s *socket) closeConnection() error {
+	err := s.rwc.Close()
+	s.doneOnce.Do(func() {
+		close(s.done)
+
+		s.recordClose(CloseCodeAbnormalClosure, "", false)
+		s.closeMu.Lock()
+		code, reason, remote := s.closeCode, s.closeReason, s.closeRemote
+		s.closeMu.Unlock()
+		if s.closeHandler != nil {
+			s.closeHandler(code, reason, remote)
+		}
+	})
+	return err
+}
+
+func (s *socket) OnClose(h CloseHandler) {
+	s.closeHandler = h
+}
+
+// recordClose keeps the close frame that started the closing handshake, the first one wins
+func (s *socket) recordClose(code uint16, reason string, remote bool) {
+	s.closeMu.Lock()
+	defer s.closeMu.Unlock()
+
+	if s.closeRecorded {
+		return
+	}
+	s.closeRecorded = true
+	s.closeCode = code
+	s.closeReason = reason
+	s.closeRemote = remote
+}
+
+// SetWriteDeadline sets the write deadline of the underlying connection,
+// ErrDeadlineUnsupported is returned when it is not a net.Conn
+func (s *socket) SetWriteDeadline(t time.Time) error {
+	conn, ok := s.rwc.(interface{ SetWriteDeadline(time.Time) error })
+	if !ok {
+		return ErrDeadlineUnsupported
+	}
+	return conn.SetWriteDeadline(t)
+}
+
+// ID returns an identifier unique among all the sockets of the process
+func (s *socket) ID() uint64 {
+	return s.id
+}
+
+// Done returns a channel closed once the underlying connection is closed
+func (s *socket) Done() <-chan struct{} {
+	return s.done
+}
+
+// startClosingHandshake sends a close frame and waits for the read loop
+// to receive the peer reply, the connection is left open
+func (s *socket) startClosingHandshake(code uint16, reason string) {
+	if !s.setStatusFrom(SocketStatusClosing, SocketStatusOpen) {
+		return
+	}
+	s.recordClose(code, reason, false)
+	s.sendClose(closePayload(code, reason))
+}
+
+// keepalive pings the peer every ping interval and drops the connection
+// when a pong is not received within the pong timeout
+func (s *socket) keepalive() {
+	ticker := time.NewTicker(s.pingInterval)
+	defer ticker.Stop()
 
 	for {
-		switch s.status {
-		case SocketStatusClosed:
-			return s.rwc.Close()
-		case SocketStatusClosing:
-			// If we were nice we would wait for the endpoint to reply our close message
-			// Unfortunately this leads to some complications
-			// For example, we need to read the offending message entirely before we can
-			// read the close reply (or any other frame)
-			s.status = SocketStatusClosed
-		default:
-			closeCode := make([]byte, 2)
-			binary.BigEndian.PutUint16(closeCode, CloseCodeGoingAway)
-			s.sendClose(closeCode)
-			s.status = SocketStatusClosing
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
 		}
 
-		if s.status != SocketStatusClosing {
-			break
+		payload := make([]byte, 8)
+		now := time.Now()
+		binary.BigEndian.PutUint64(payload, uint64(now.UnixNano()))
+		s.keepaliveMu.Lock()
+		s.pingPayload = payload
+		s.pingSentAt = now
+		s.keepaliveMu.Unlock()
+
+		if err := s.Ping(payload); err != nil {
+			return
+		}
+		if s.pongTimeout <= 0 {
+			continue
+		}
+
+		timer := time.NewTimer(s.pongTimeout)
+		select {
+		case <-s.done:
+			timer.Stop()
+			return
+		case <-s.pongCh:
+			timer.Stop()
+		case <-timer.C:
+			// the peer is unreachable, a closing handshake would not complete
+			s.drop()
+			return
 		}
 	}
-	return s.rwc.Close()
+}
+
+// receivePong measures the round trip time when the pong answers our last ping
+func (s *socket) receivePong(payload []byte) {
+	s.keepaliveMu.Lock()
+	if s.pingPayload != nil && bytes.Equal(payload, s.pingPayload) {
+		atomic.StoreInt64(&s.rtt, int64(time.Since(s.pingSentAt)))
+		s.pingPayload = nil
+		select {
+		case s.pongCh <- struct{}{}:
+		default:
+		}
+	}
+	s.keepaliveMu.Unlock()
+
+	if s.pongHandler != nil {
+		s.pongHandler(payload)
+	}
+}
+
+// Ping sends a ping frame, payloads are limited to 125 bytes.
+// It fails with ErrSocketNotOpen once the socket is not open
+func (s *socket) Ping(payload []byte) error {
+	if len(payload) > 125 {
+		return ErrControlPayloadTooLong
+	}
+	if s.Status() != SocketStatusOpen {
+		return ErrSocketNotOpen
+	}
+	return s.sendFrame(OPCODE_PING, bytes.NewReader(payload), true)
+}
+
+func (s *socket) OnPong(h PongHandler) {
+	s.pongHandler = h
+}
+
+// RTT returns the round trip time measured by the last answered automatic ping
+func (s *socket) RTT() time.Duration {
+	return time.Duration(atomic.LoadInt64(&s.rtt))
 }
 
 func (s *socket) sendPong(payload []byte) {
-	data := generateMessageFrame(bytes.NewReader(payload), uint64(len(payload)), OPCODE_PONG, true)
 	// TODO: handle error
-	s.rwc.Write(data)
+	s.sendFrame(OPCODE_PONG, bytes.NewReader(payload), true)
 }
 
 func (s *socket) sendCloseWithCode(code uint16) {
-	closeCode := make([]byte, 2)
-	binary.BigEndian.PutUint16(closeCode, code)
-	s.sendClose(closeCode)
+	s.sendClose(closePayload(code, ""))
 }
 
-func (s *socket) sendClose(payload []byte) {
-	s.sendFrame(OPCODE_CLOSE, bytes.NewReader(payload), true)
+func (s *socket) sendClose(payload []byte) error {
+	return s.sendFrame(OPCODE_CLOSE, bytes.NewReader(payload), true)
 }
 
 func (s *socket) sendFrame(messageType byte, r io.Reader, fin bool) error {
+	return s.sendFrameWithRSV(messageType, 0, r, fin)
+}
+
+func (s *socket) sendFrameWithRSV(messageType byte, rsv byte, r io.Reader, fin bool) error {
 	buf := bytes.NewBuffer([]byte{})
 	io.Copy(buf, r)
 
-	fmt.Printf("TX Fin=%t Opcode=%d Len=%d\n", fin, messageType, buf.Len())
-	data := generateMessageFrame(bytes.NewReader(buf.Bytes()), uint64(buf.Len()), messageType, fin)
+	// client to server frames must always be masked
+	data := encodeFrame(FrameEncodeOptions{
+		r:             bytes.NewReader(buf.Bytes()),
+		payloadLength: uint64(buf.Len()),
+		opCode:        messageType,
+		rsv:           rsv,
+		fin:           fin,
+		mask:          s.isClient,
+	})
+	if isControlFrame(messageType) {
+		return s.write(data)
+	}
+	return s.writeData(data)
+}
+
+// write sends already encoded frames, it is safe for concurrent use
+func (s *socket) write(data []byte) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	_, err := s.rwc.Write(data)
+	return err
+}
+
+// writeData sends already encoded data frames, which RFC 6455 forbids
+// once our close frame is sent, so they are refused as soon as the socket is not open
+func (s *socket) writeData(data []byte) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if s.Status() != SocketStatusOpen {
+		return ErrSocketNotOpen
+	}
 	_, err := s.rwc.Write(data)
 	return err
 }
@@ -229,6 +822,12 @@ func (s *socket) OnFrame(h FrameHandler) {
 	s.frameHandler = h
 }
 
+func (s *socket) dispatchFrame(opcode byte, payload []byte, fin bool) {
+	if s.frameHandler != nil {
+		s.frameHandler(opcode, payload, fin)
+	}
+}
+
 func (s *socket) OnText(h TextHandler) {
 	s.textHandler = h
 }
@@ -241,71 +840,360 @@ func (s *socket) OnStreamStart(h StreamStartHandler) {
 	s.streamStartHandler = h
 }
 
-func (s *socket) SendMessage(t byte, r io.Reader) {
-	panic("Not implemented")
+func (s *socket) SetMaxFrameSize(size int) {
+	s.maxFrameSize = size
+}
+
+func (s *socket) frameSize() int {
+	if s.maxFrameSize <= 0 {
+		return DefaultMaxFrameSize
+	}
+	return s.maxFrameSize
+}
+
+// SendMessage sends the whole content of r as a single message.
+// Payloads longer than the max frame size are split into continuation frames;
+// the first read chunk is always sent before the rest of r is consumed,
+// unless extensions are negotiated, in which case r is read entirely first.
+// Concurrent calls are serialized, control frames may still be sent between
+// the fragments of a message
+func (s *socket) SendMessage(t MessageType, r io.Reader) error {
+	if t != MESSAGE_TYPE_TEXT && t != MESSAGE_TYPE_BINARY {
+		return ErrInvalidMessageType
+	}
+
+	s.messageMu.Lock()
+	defer s.messageMu.Unlock()
+
+	if s.Status() != SocketStatusOpen {
+		return ErrSocketNotOpen
+	}
+	if len(s.extensions) == 0 {
+		return s.sendFragments(byte(t), 0, r)
+	}
+
+	payload, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	encoded, rsv, err := s.encodeMessage(byte(t), payload)
+	if err != nil {
+		return err
+	}
+	return s.sendFragments(byte(t), rsv, bytes.NewReader(encoded))
+}
+
+// sendFragments sends r as a message, rsv bits are set on the first frame only
+func (s *socket) sendFragments(opcode byte, rsv byte, r io.Reader) error {
+	current := make([]byte, s.frameSize())
+	next := make([]byte, s.frameSize())
+
+	n, err := io.ReadFull(r, current)
+	for {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return s.sendFrameWithRSV(opcode, rsv, bytes.NewReader(current[:n]), true)
+		}
+		if err != nil {
+			return err
+		}
+
+		// a full frame was read, look ahead to know whether it is the last one
+		m, nextErr := io.ReadFull(r, next)
+		if nextErr != nil && nextErr != io.EOF && nextErr != io.ErrUnexpectedEOF {
+			return nextErr
+		}
+		fin := m == 0
+		if err := s.sendFrameWithRSV(opcode, rsv, bytes.NewReader(current[:n]), fin); err != nil {
+			return err
+		}
+		if fin {
+			return nil
+		}
+
+		opcode = OPCODE_CONTINUATION
+		rsv = 0
+		current, next = next, current
+		n, err = m, nextErr
+	}
 }
 
-func (c *socket) handshake() error {
+func (c *socket) handshake(options ServerOptions) error {
 
-	scanner := bufio.NewScanner(c.rwc)
+	// the limit is lifted once the request is read, the frames follow it
+	limited := &io.LimitedReader{R: c.rwc, N: options.maxHeaderBytes()}
+	c.br = bufio.NewReader(limited)
+	req, err := http.ReadRequest(c.br)
+	if err != nil {
+		if limited.N <= 0 {
+			err = ErrHandshakeTooLarge
+		} else {
+			err = ErrMalformedHandshake
+		}
+		writeHandshakeFailure(c.rwc, err)
+		c.setStatus(SocketStatusClosed)
+		return err
+	}
+	limited.N = math.MaxInt64
 
-	// Read status line
-	scanner.Scan()
-	headers := scanHeaders(scanner)
-	if value, ok := headers["connection"]; !ok || strings.ToLower(value) != "upgrade" {
-		c.status = SocketStatusClosed
-		return ErrMissingUpgrade
+	// the body, if any, would be read from the frames
+	req.Body = http.NoBody
+	if conn, ok := c.rwc.(net.Conn); ok {
+		req.RemoteAddr = conn.RemoteAddr().String()
+	}
+	response, err := c.acceptUpgrade(req, options)
+	if err != nil {
+		if c.upgradeResponse.rejects() {
+			writeUpgradeRejection(c.rwc, c.upgradeResponse)
+		} else {
+			writeHandshakeFailure(c.rwc, err)
+		}
+		c.setStatus(SocketStatusClosed)
+		return err
 	}
 
-	if value, ok := headers["upgrade"]; !ok || strings.ToLower(value) != "websocket" {
-		c.status = SocketStatusClosed
-		return ErrInvalidUpgrade
+	if _, err := c.rwc.Write([]byte(response)); err != nil {
+		c.setStatus(SocketStatusClosed)
+		return err
 	}
 
-	if _, ok := headers["sec-websocket-key"]; !ok {
-		c.status = SocketStatusClosed
-		return ErrInvalidWebsocketKey
+	c.setStatus(SocketStatusOpen)
+	return nil
+}
+
+// validateUpgradeRequest checks the upgrade request against RFC 6455
+// and returns the Sec-WebSocket-Accept value to reply with
+func validateUpgradeRequest(req *http.Request) (string, error) {
+	if req.Method != http.MethodGet {
+		return "", ErrInvalidMethod
 	}
 
-	acceptKey := generateWebsocketAccept(headers["sec-websocket-key"])
+	if !req.ProtoAtLeast(1, 1) {
+		return "", ErrInvalidHTTPVersion
+	}
+
+	if req.Host == "" {
+		return "", ErrMissingHost
+	}
+
+	if !hasToken(headerTokens(req.Header, "Connection"), "upgrade") {
+		return "", ErrMissingUpgrade
+	}
 
-	responseMessage := strings.Join([]string{
+	if !hasToken(headerTokens(req.Header, "Upgrade"), "websocket") {
+		return "", ErrInvalidUpgrade
+	}
+
+	if versions := req.Header.Values("Sec-WebSocket-Version"); len(versions) != 1 || versions[0] != WEBSOCKET_VERSION {
+		return "", ErrUnsupportedVersion
+	}
+
+	// the key is a base64 encoded random 16 bytes nonce
+	keys := req.Header.Values("Sec-WebSocket-Key")
+	if len(keys) != 1 {
+		return "", ErrInvalidWebsocketKey
+	}
+	if nonce, err := base64.StdEncoding.DecodeString(keys[0]); err != nil || len(nonce) != 16 {
+		return "", ErrInvalidWebsocketKey
+	}
+
+	return generateWebsocketAccept(keys[0]), nil
+}
+
+// acceptUpgrade validates the upgrade request, negotiates the connection
+// parameters against the server options and returns the 101 response to send
+func (c *socket) acceptUpgrade(req *http.Request, options ServerOptions) (string, error) {
+	acceptKey, err := validateUpgradeRequest(req)
+	if err != nil {
+		return "", err
+	}
+
+	c.request = req
+	if !options.OriginPolicy.allows(req) {
+		return "", ErrForbiddenOrigin
+	}
+	if c.upgradeResponse, err = checkUpgrade(req, options); err != nil {
+		return "", err
+	}
+
+	var extraHeaders []string
+	c.subprotocol = selectSubprotocol(headerTokens(req.Header, "Sec-WebSocket-Protocol"), options.Subprotocols)
+	if c.subprotocol != "" {
+		extraHeaders = append(extraHeaders, fmt.Sprintf("Sec-WebSocket-Protocol: %s", c.subprotocol))
+	}
+
+	offers := parseExtensions(strings.Join(req.Header.Values("Sec-WebSocket-Extensions"), ", "))
+	c.extensionParams, c.extensions = negotiateExtensions(offers, withDeflate(options.PerMessageDeflate, options.Extensions))
+	if len(c.extensionParams) > 0 {
+		extraHeaders = append(extraHeaders, fmt.Sprintf("Sec-WebSocket-Extensions: %s", formatExtensions(c.extensionParams)))
+	}
+	if c.upgradeResponse != nil {
+		extraHeaders = append(extraHeaders, headerLines(c.upgradeResponse.Header)...)
+	}
+
+	return handshakeResponse(acceptKey, extraHeaders...), nil
+}
+
+func handshakeResponse(acceptKey string, extraHeaders ...string) string {
+	lines := []string{
 		"HTTP/1.1 101 Switching Protocols",
 		"Connection: Upgrade",
 		"Upgrade: websocket",
 		fmt.Sprintf("Sec-WebSocket-Accept: %s", acceptKey),
-		"\r\n",
-	}, "\r\n")
+	}
+	lines = append(lines, extraHeaders...)
+	lines = append(lines, "\r\n")
+	return strings.Join(lines, "\r\n")
+}
 
-	if _, err := c.rwc.Write([]byte(responseMessage)); err != nil {
-		c.status = SocketStatusClosed
-		return err
+// selectSubprotocol returns the first supported subprotocol also offered by the client,
+// so the server preference wins
+func selectSubprotocol(offered []string, supported []string) string {
+	for _, protocol := range supported {
+		for _, o := range offered {
+			if o == protocol {
+				return protocol
+			}
+		}
 	}
+	return ""
+}
 
-	c.status = SocketStatusOpen
-	return nil
+// parseTokenList splits a comma separated header value into its trimmed elements
+func parseTokenList(value string) []string {
+	var tokens []string
+	for _, token := range strings.Split(value, ",") {
+		token = strings.TrimSpace(token)
+		if token != "" {
+			tokens = append(tokens, token)
+		}
+	}
+	return tokens
 }
 
-func (s *socket) Status() int {
-	return s.status
+// headerTokens collects the token lists of every occurrence of a header
+func headerTokens(header http.Header, name string) []string {
+	var tokens []string
+	for _, value := range header.Values(name) {
+		tokens = append(tokens, parseTokenList(value)...)
+	}
+	return tokens
+}
+
+// hasToken looks for a case insensitive token
+func hasToken(tokens []string, token string) bool {
+	for _, t := range tokens {
+		if strings.EqualFold(t, token) {
+			return true
+		}
+	}
+	return false
+}
+
+// handshakeFailure returns the HTTP status and headers answering a rejected upgrade request
+func handshakeFailure(err error) (int, http.Header) {
+	header := http.Header{}
+	switch err {
+	case ErrMissingUpgrade, ErrInvalidUpgrade:
+		header.Set("Upgrade", "websocket")
+		return http.StatusUpgradeRequired, header
+	case ErrUnsupportedVersion:
+		header.Set("Sec-WebSocket-Version", WEBSOCKET_VERSION)
+		return http.StatusUpgradeRequired, header
+	case ErrInvalidMethod:
+		header.Set("Allow", http.MethodGet)
+		return http.StatusMethodNotAllowed, header
+	case ErrForbiddenOrigin:
+		return http.StatusForbidden, header
+	case ErrHandshakeTooLarge:
+		return http.StatusRequestHeaderFieldsTooLarge, header
+	}
+	return http.StatusBadRequest, header
+}
+
+// writeHandshakeFailure answers a rejected upgrade request on a raw connection
+func writeHandshakeFailure(w io.Writer, err error) error {
+	status, header := handshakeFailure(err)
+	body := err.Error() + "\n"
+	header.Set("Content-Type", "text/plain; charset=utf-8")
+	header.Set("Connection", "close")
+	res := &http.Response{
+		StatusCode:    status,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+	}
+	return res.Write(w)
+}
+
+// Subprotocol returns the subprotocol agreed during the handshake,
+// empty when none was negotiated
+func (s *socket) Subprotocol() string {
+	return s.subprotocol
+}
+
+// Extensions returns the extensions agreed during the handshake, in negotiation order
+func (s *socket) Extensions() []ExtensionParams {
+	return s.extensionParams
+}
+
+// TLSConnectionState returns the state of the underlying TLS connection,
+// false is returned for plain connections
+func (s *socket) TLSConnectionState() (tls.ConnectionState, bool) {
+	if conn, ok := s.rwc.(*tls.Conn); ok {
+		return conn.ConnectionState(), true
+	}
+	return tls.ConnectionState{}, false
+}
+
+// reader returns the buffered reader of the connection
+func (s *socket) reader() *bufio.Reader {
+	if s.br == nil {
+		s.br = bufio.NewReader(s.rwc)
+	}
+	return s.br
 }
 
 func (s *socket) readFrame() (*frame, error) {
 	// non-control frames (0 first bit) higher than 2 are reserved
 	// control frames (1 first bit) higher than 10 are reserved
 	return decodeFrame(decodeFrameSettings{
-		reader:                          s.rwc,
+		reader:                          s.reader(),
 		expectedContinuationMessageType: s.expectedContinuationMessageType,
 		danglingUTF8Bytes:               s.danglingUTF8Bytes,
-		expectedMask:                    true,
+		expectedMask:                    !s.isClient,
+		allowedRSV:                      s.allowedRSV(),
+		transformedMessage:              s.transformedMessage,
+		maxFramePayloadSize:             s.frameLimit(),
+		maxMessageSize:                  s.messageLimit(),
+		messageReceived:                 s.messageReceived,
 	})
 }
 
+// allowedRSV returns the RSV bits owned by the negotiated extensions
+func (s *socket) allowedRSV() byte {
+	rsv := byte(0)
+	for _, extension := range s.extensions {
+		rsv |= extension.RSV()
+	}
+	return rsv
+}
+
 type decodeFrameSettings struct {
 	reader                          io.Reader
 	expectedContinuationMessageType byte
 	danglingUTF8Bytes               []byte
 	expectedMask                    bool
+	// allowedRSV holds the RSV bits that may be set on the first frame of a message
+	allowedRSV byte
+	// transformedMessage is set while reading the continuation frames of a message with RSV bits
+	transformedMessage bool
+	// size limits are checked before allocating the payload, zero means no limit
+	maxFramePayloadSize uint64
+	maxMessageSize      uint64
+	// messageReceived is the payload length of the previous frames of the current message
+	messageReceived uint64
 }
 
 func decodeFrame(settings decodeFrameSettings) (*frame, error) {
@@ -315,14 +1203,16 @@ func decodeFrame(settings decodeFrameSettings) (*frame, error) {
 	}
 	flags := frameStart[0]
 	fin := flags&0x80 != 0
-	rsv1 := flags&0x40 != 0
-	rsv2 := flags&0x20 != 0
-	rsv3 := flags&0x10 != 0
+	rsv1 := flags&RSV1 != 0
+	rsv2 := flags&RSV2 != 0
+	rsv3 := flags&RSV3 != 0
+	opcode := flags & 0x0f
 
-	if rsv1 || rsv2 || rsv3 {
+	// extension bits are only meaningful on the first frame of a data message
+	rsv := flags & (RSV1 | RSV2 | RSV3)
+	if rsv&^settings.allowedRSV != 0 || (rsv != 0 && (isControlFrame(opcode) || opcode == OPCODE_CONTINUATION)) {
 		return nil, ErrInvalidRSV
 	}
-	opcode := flags & 0x0f
 
 	isReservedOpcode := (opcode & 0x7) > 2
 
@@ -346,6 +1236,10 @@ func decodeFrame(settings decodeFrameSettings) (*frame, error) {
 		return nil, ErrUnmaskedframe
 	}
 
+	if mask && !settings.expectedMask {
+		return nil, ErrMaskedFrame
+	}
+
 	if isControlFrame(opcode) && !fin {
 		return nil, ErrFragmentedControlFrame
 	}
@@ -354,6 +1248,19 @@ func decodeFrame(settings decodeFrameSettings) (*frame, error) {
 		return nil, err
 	}
 
+	if settings.maxFramePayloadSize > 0 && payloadLength > settings.maxFramePayloadSize {
+		return nil, ErrFrameTooBig
+	}
+	if settings.maxMessageSize > 0 && !isControlFrame(opcode) {
+		received := settings.messageReceived
+		if opcode != OPCODE_CONTINUATION {
+			received = 0
+		}
+		if received > settings.maxMessageSize || payloadLength > settings.maxMessageSize-received {
+			return nil, ErrMessageTooBig
+		}
+	}
+
 	var maskingKey []byte
 	if mask {
 		maskingKey, err = readAll(settings.reader, 4)
@@ -373,7 +1280,10 @@ func decodeFrame(settings decodeFrameSettings) (*frame, error) {
 	}
 
 	var danglingBytes = settings.danglingUTF8Bytes
-	if settings.expectedContinuationMessageType == OPCODE_TEXT && !isControlFrame(opcode) {
+	// transformed payloads are validated once decoded by the extensions
+	transformed := rsv != 0 || settings.transformedMessage
+	isText := opcode == OPCODE_TEXT || (opcode == OPCODE_CONTINUATION && settings.expectedContinuationMessageType == OPCODE_TEXT)
+	if isText && !transformed {
 		danglingBytes, err = validTextFragment(unmasked, settings.danglingUTF8Bytes, fin)
 		if err != nil {
 			return &frame{}, err
@@ -459,6 +1369,7 @@ type FrameEncodeOptions struct {
 	r             io.Reader
 	payloadLength uint64
 	opCode        byte
+	rsv           byte
 	fin           bool
 	mask          bool
 }
@@ -485,7 +1396,7 @@ func encodeFrame(options FrameEncodeOptions) []byte {
 		start = 0x80
 	}
 	header := []byte{
-		start | opCode,
+		start | options.rsv | opCode,
 	}
 	var extraPayloadLengthBytes int = 0
 	var firstPayloadLengthByte byte
@@ -512,8 +1423,11 @@ func encodeFrame(options FrameEncodeOptions) []byte {
 	payload, _ := readAll(r, payloadLength)
 
 	if options.mask {
+		// RFC 6455 requires unpredictable masking keys, see section 10.3
 		maskKey := make([]byte, 4)
-		binary.BigEndian.PutUint32(maskKey, rand.Uint32())
+		if _, err := rand.Read(maskKey); err != nil {
+			panic(err)
+		}
 		payload = maskData(payload, maskKey)
 		header = append(header, maskKey...)
 	}
@@ -559,6 +1473,29 @@ func isControlFrame(opcode byte) bool {
 	return (opcode & 0x8) == 0x8
 }
 
+func closePayload(code uint16, reason string) []byte {
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, code)
+	return append(payload, reason...)
+}
+
+func parseClosePayload(payload []byte) (uint16, string) {
+	if len(payload) < 2 {
+		return CloseCodeNoStatus, ""
+	}
+	return binary.BigEndian.Uint16(payload[0:2]), string(payload[2:])
+}
+
+func validateClose(code uint16, reason string) error {
+	if _, ok := validCloseCodes[code]; !ok && (code < 3000 || code >= 5000) {
+		return ErrInvalidCloseCode
+	}
+	if len(reason) > MaxCloseReasonLength || !utf8.ValidString(reason) {
+		return ErrInvalidCloseReason
+	}
+	return nil
+}
+
 func ensureValidCloseCode(payload []byte) []byte {
 	if len(payload) == 0 {
 		return payload
@@ -2,8 +2,13 @@ package ws
 
 import (
 	"bytes"
+	"context"
 	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 )
 
 type MockedReadWriteCloser struct {
@@ -20,13 +25,12 @@ func (mrwc *MockedReadWriteCloser) Close() error {
 func createTestSocket() (*socket, io.ReadWriteCloser) {
 	serverR, clientW := io.Pipe()
 	clientR, serverW := io.Pipe()
-	socket := &socket{
-		rwc: &MockedReadWriteCloser{
-			serverR,
-			serverW,
-			false,
-		},
-	}
+	socket := newSocket(&MockedReadWriteCloser{
+		serverR,
+		serverW,
+		false,
+	}, nil)
+	socket.setStatus(SocketStatusOpen)
 
 	return socket, &MockedReadWriteCloser{
 		clientR,
@@ -72,3 +76,381 @@ func TestPingReply(t *testing.T) {
 		return
 	}
 }
+
+func TestSendMessageFragmentation(t *testing.T) {
+	s, rwc := createTestSocket()
+	s.SetMaxFrameSize(4)
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.SendMessage(MESSAGE_TYPE_TEXT, strings.NewReader("hello world!"))
+	}()
+
+	expected := []struct {
+		opcode  byte
+		payload string
+		fin     bool
+	}{
+		{OPCODE_TEXT, "hell", false},
+		{OPCODE_CONTINUATION, "o wo", false},
+		{OPCODE_CONTINUATION, "rld!", true},
+	}
+
+	continuationType := byte(0)
+	for i, e := range expected {
+		frame, err := decodeFrame(decodeFrameSettings{
+			reader:                          rwc,
+			expectedContinuationMessageType: continuationType,
+			expectedMask:                    false,
+		})
+		continuationType = OPCODE_TEXT
+		if err != nil {
+			t.Fatal("Unexpected error while decoding frame", err)
+		}
+		if frame.Opcode != e.opcode || string(frame.Payload) != e.payload || frame.Fin != e.fin {
+			t.Errorf("Frame %d: got opcode=%d payload=%q fin=%t", i, frame.Opcode, frame.Payload, frame.Fin)
+		}
+	}
+
+	if err := <-errCh; err != nil {
+		t.Error("Unexpected send error", err)
+	}
+}
+
+func TestKeepalive(t *testing.T) {
+	pongs := make(chan []byte, 1)
+	sockets := make(chan Socket, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u := NewUpgraderWithOptions(ServerOptions{
+			SocketOptions: SocketOptions{PingInterval: 10 * time.Millisecond, PongTimeout: time.Second},
+		})
+		s, err := u.Upgrade(w, r)
+		if err != nil {
+			t.Error("Unexpected upgrade error", err)
+			return
+		}
+		s.OnPong(func(payload []byte) {
+			select {
+			case pongs <- payload:
+			default:
+			}
+		})
+		sockets <- s
+		go s.Run()
+	}))
+	defer srv.Close()
+
+	client, err := Dial(context.Background(), "ws"+strings.TrimPrefix(srv.URL, "http"), DialOptions{})
+	if err != nil {
+		t.Fatal("Unexpected dial error", err)
+	}
+	defer client.Close()
+	go client.Run()
+
+	s := <-sockets
+	select {
+	case payload := <-pongs:
+		if len(payload) != 8 {
+			t.Error("Unexpected pong payload", payload)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Pong not received")
+	}
+	waitFor(t, func() bool { return s.RTT() > 0 })
+}
+
+func TestPongTimeout(t *testing.T) {
+	s, conn := newPipeSocket()
+	s.applyOptions(SocketOptions{PingInterval: 10 * time.Millisecond, PongTimeout: 20 * time.Millisecond})
+	go s.Run()
+
+	// the peer reads our ping but never answers
+	f, err := decodeFrame(decodeFrameSettings{reader: conn})
+	if err != nil || f.Opcode != OPCODE_PING {
+		t.Fatal("Ping not sent", err)
+	}
+
+	select {
+	case <-s.Done():
+	case <-time.After(time.Second):
+		t.Error("Connection not dropped after the pong timeout")
+	}
+}
+
+func TestClosingHandshake(t *testing.T) {
+	s, conn := newPipeSocket()
+	texts := make(chan string, 1)
+	s.OnText(func(text string) {
+		texts <- text
+	})
+	go s.Run()
+
+	closed := make(chan error, 1)
+	go func() {
+		closed <- s.CloseWithCode(CloseCodeNormal, "done")
+	}()
+
+	f, err := decodeFrame(decodeFrameSettings{reader: conn})
+	if err != nil || f.Opcode != OPCODE_CLOSE {
+		t.Fatal("Close frame not sent", err)
+	}
+
+	// frames sent before our reply are drained without being dispatched
+	for _, opcode := range []byte{OPCODE_TEXT, OPCODE_CLOSE} {
+		payload := []byte("late")
+		if opcode == OPCODE_CLOSE {
+			payload = closePayload(CloseCodeNormal, "")
+		}
+		conn.Write(encodeFrame(FrameEncodeOptions{
+			r:             bytes.NewReader(payload),
+			payloadLength: uint64(len(payload)),
+			opCode:        opcode,
+			fin:           true,
+			mask:          true,
+		}))
+		select {
+		case <-s.Done():
+			if opcode != OPCODE_CLOSE {
+				t.Fatal("Connection closed before the close reply")
+			}
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Error("Unexpected close error", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Close did not return after the reply")
+	}
+	select {
+	case text := <-texts:
+		t.Error("Frame dispatched while closing", text)
+	default:
+	}
+}
+
+func TestCloseFromHandler(t *testing.T) {
+	s, conn := newPipeSocket()
+	closed := make(chan error, 1)
+	s.OnText(func(text string) {
+		closed <- s.CloseWithCode(CloseCodeNormal, text)
+	})
+	go s.Run()
+
+	go writeClientFrame(conn, OPCODE_TEXT, []byte("bye"), true)
+	f, err := decodeFrame(decodeFrameSettings{reader: conn})
+	if err != nil || f.Opcode != OPCODE_CLOSE {
+		t.Fatal("Close frame not sent", err)
+	}
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Error("Unexpected close error", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Close waited for the reply in the handler")
+	}
+
+	go writeClientFrame(conn, OPCODE_CLOSE, closePayload(CloseCodeNormal, ""), true)
+	select {
+	case <-s.Done():
+	case <-time.After(time.Second):
+		t.Fatal("Connection not closed after the reply")
+	}
+}
+
+func TestCloseFromHandlerTimeout(t *testing.T) {
+	s, conn := newPipeSocket()
+	s.applyOptions(SocketOptions{CloseTimeout: 50 * time.Millisecond})
+	s.OnText(func(text string) {
+		s.Close()
+	})
+	go s.Run()
+
+	go func() {
+		writeClientFrame(conn, OPCODE_TEXT, []byte("bye"), true)
+		io.Copy(io.Discard, conn)
+	}()
+	select {
+	case <-s.Done():
+	case <-time.After(time.Second):
+		t.Fatal("Connection not closed after the close timeout")
+	}
+}
+
+func TestCloseDuringHandler(t *testing.T) {
+	s, conn := newPipeSocket()
+	handling := make(chan struct{})
+	release := make(chan struct{})
+	s.OnText(func(text string) {
+		close(handling)
+		<-release
+	})
+	go s.Run()
+
+	go writeClientFrame(conn, OPCODE_TEXT, []byte("busy"), true)
+	<-handling
+	closed := make(chan error, 1)
+	go func() {
+		closed <- s.Close()
+	}()
+
+	f, err := decodeFrame(decodeFrameSettings{reader: conn})
+	if err != nil || f.Opcode != OPCODE_CLOSE {
+		t.Fatal("Close frame not sent", err)
+	}
+	select {
+	case <-closed:
+		t.Fatal("Close returned before the reply")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	close(release)
+	go writeClientFrame(conn, OPCODE_CLOSE, closePayload(CloseCodeNormal, ""), true)
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Close did not return after the reply")
+	}
+	select {
+	case <-s.Done():
+	default:
+		t.Error("Close returned with the connection open")
+	}
+}
+
+func TestCloseTimeout(t *testing.T) {
+	s, conn := newPipeSocket()
+	s.applyOptions(SocketOptions{CloseTimeout: 50 * time.Millisecond})
+	go io.Copy(io.Discard, conn)
+
+	start := time.Now()
+	s.Close()
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond || elapsed > time.Second {
+		t.Error("Close did not wait for the timeout", elapsed)
+	}
+	select {
+	case <-s.Done():
+	default:
+		t.Error("Connection not closed after the timeout")
+	}
+}
+
+func TestMessageTooBig(t *testing.T) {
+	s, conn := newPipeSocket()
+	s.SetReadLimits(16, 24)
+	s.OnText(func(text string) {})
+	codes := make(chan uint16, 1)
+	s.OnClose(func(code uint16, reason string, remote bool) {
+		codes <- code
+	})
+	go s.Run()
+
+	// each frame fits, the reassembled message does not
+	go func() {
+		for i, opcode := range []byte{OPCODE_TEXT, OPCODE_CONTINUATION} {
+			payload := bytes.Repeat([]byte("a"), 16)
+			conn.Write(encodeFrame(FrameEncodeOptions{
+				r:             bytes.NewReader(payload),
+				payloadLength: uint64(len(payload)),
+				opCode:        opcode,
+				fin:           i == 1,
+				mask:          true,
+			}))
+		}
+	}()
+
+	f, err := decodeFrame(decodeFrameSettings{reader: conn})
+	if err != nil || f.Opcode != OPCODE_CLOSE {
+		t.Fatal("Close frame not sent", err)
+	}
+	if code, _ := parseClosePayload(f.Payload); code != CloseCodeMessageTooBig {
+		t.Error("Unexpected close code", code)
+	}
+	conn.Close()
+	select {
+	case code := <-codes:
+		if code != CloseCodeMessageTooBig {
+			t.Error("Unexpected recorded close code", code)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Close handler not called")
+	}
+}
+
+func TestFrameTooBig(t *testing.T) {
+	s, conn := newPipeSocket()
+	s.SetReadLimits(8, -1)
+	go s.Run()
+
+	// the payload is never sent, the header alone must trigger the close
+	header := []byte{0x80 | OPCODE_BINARY, 0x80 | 127, 0, 0, 1, 0, 0, 0, 0, 0, 1, 2, 3, 4}
+	go conn.Write(header)
+
+	f, err := decodeFrame(decodeFrameSettings{reader: conn})
+	if err != nil || f.Opcode != OPCODE_CLOSE {
+		t.Fatal("Close frame not sent", err)
+	}
+	if code, _ := parseClosePayload(f.Payload); code != CloseCodeMessageTooBig {
+		t.Error("Unexpected close code", code)
+	}
+}
+
+func TestConcurrentWrites(t *testing.T) {
+	s, conn := newPipeSocket()
+	s.SetMaxFrameSize(8)
+
+	const writers = 8
+	errs := make(chan error, 2*writers)
+	for i := 0; i < writers; i++ {
+		go func(b byte) {
+			errs <- s.SendMessage(MESSAGE_TYPE_BINARY, bytes.NewReader(bytes.Repeat([]byte{b}, 50)))
+		}(byte('a' + i))
+		go func() {
+			errs <- s.Ping([]byte("ping"))
+		}()
+	}
+
+	messages, pings := 0, 0
+	var current []byte
+	for messages < writers || pings < writers {
+		settings := decodeFrameSettings{reader: conn}
+		if current != nil {
+			settings.expectedContinuationMessageType = OPCODE_BINARY
+		}
+		f, err := decodeFrame(settings)
+		if err != nil {
+			t.Fatal("Interleaved frame bytes", err)
+		}
+		switch f.Opcode {
+		case OPCODE_PING:
+			pings++
+			continue
+		case OPCODE_BINARY:
+			if current != nil {
+				t.Fatal("Message started before the previous one ended")
+			}
+			current = f.Payload
+		case OPCODE_CONTINUATION:
+			if current == nil {
+				t.Fatal("Unexpected continuation frame")
+			}
+			current = append(current, f.Payload...)
+		}
+		if f.Fin {
+			if !bytes.Equal(current, bytes.Repeat(current[:1], 50)) {
+				t.Error("Message fragments mixed up", string(current))
+			}
+			messages++
+			current = nil
+		}
+	}
+	for i := 0; i < 2*writers; i++ {
+		if err := <-errs; err != nil {
+			t.Error("Unexpected write error", err)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package ws
+
+// StateChangeHandler is called after each status transition of a socket,
+// from the goroutine that caused it
+type StateChangeHandler func(from int, to int)
+
+// socketTransitions lists the statuses reachable from each status,
+// a socket only ever moves forward and never leaves SocketStatusClosed
+var socketTransitions = map[int][]int{
+	SocketStatusOpening: {SocketStatusOpen, SocketStatusClosing, SocketStatusClosed},
+	SocketStatusOpen:    {SocketStatusClosing, SocketStatusClosed},
+	SocketStatusClosing: {SocketStatusClosed},
+	SocketStatusClosed:  {},
+}
+
+func canTransition(from int, to int) bool {
+	for _, status := range socketTransitions[from] {
+		if status == to {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *socket) Status() int {
+	s.stateMu.Lock()
+	defer s.stateMu.Unlock()
+	return s.status
+}
+
+// OnStateChange registers a handler called on every status transition
+func (s *socket) OnStateChange(h StateChangeHandler) {
+	s.stateMu.Lock()
+	defer s.stateMu.Unlock()
+	s.stateChangeHandler = h
+}
+
+// setStatus moves the socket to status, invalid transitions are ignored
+// and reported by returning false
+func (s *socket) setStatus(status int) bool {
+	return s.transition(func(from int) bool { return true }, status)
+}
+
+// setStatusFrom moves the socket to status only when its current status is one of from,
+// it lets concurrent callers agree on which of them performs the transition
+func (s *socket) setStatusFrom(status int, from ...int) bool {
+	return s.transition(func(current int) bool {
+		for _, f := range from {
+			if f == current {
+				return true
+			}
+		}
+		return false
+	}, status)
+}
+
+func (s *socket) transition(allowed func(from int) bool, to int) bool {
+	s.stateMu.Lock()
+	from := s.status
+	if !allowed(from) || !canTransition(from, to) {
+		s.stateMu.Unlock()
+		return false
+	}
+	s.status = to
+	if from < SocketStatusClosing && to >= SocketStatusClosing {
+		close(s.closing)
+	}
+	handler := s.stateChangeHandler
+	s.stateMu.Unlock()
+
+	if handler != nil {
+		handler(from, to)
+	}
+	return true
+}
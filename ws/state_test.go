@@ -0,0 +1,261 @@
+package ws
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStateTransitions(t *testing.T) {
+	s := newSocket(nil, nil)
+	var transitions [][2]int
+	s.OnStateChange(func(from int, to int) {
+		transitions = append(transitions, [2]int{from, to})
+	})
+
+	if !s.setStatus(SocketStatusOpen) || !s.setStatus(SocketStatusClosing) {
+		t.Fatal("Valid transition refused")
+	}
+	if s.setStatus(SocketStatusOpen) || s.setStatusFrom(SocketStatusClosed, SocketStatusOpen) {
+		t.Error("Invalid transition accepted")
+	}
+	if !s.setStatus(SocketStatusClosed) || s.setStatus(SocketStatusClosed) {
+		t.Error("Unexpected transition to closed")
+	}
+
+	expected := [][2]int{
+		{SocketStatusOpening, SocketStatusOpen},
+		{SocketStatusOpen, SocketStatusClosing},
+		{SocketStatusClosing, SocketStatusClosed},
+	}
+	if len(transitions) != len(expected) {
+		t.Fatal("Unexpected transitions", transitions)
+	}
+	for i := range expected {
+		if transitions[i] != expected[i] {
+			t.Error("Unexpected transitions", transitions)
+		}
+	}
+}
+
+// TestConcurrentClose is meant to be run with -race
+func TestConcurrentClose(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		s, conn := newPipeSocket()
+		s.applyOptions(SocketOptions{CloseTimeout: 100 * time.Millisecond})
+		s.OnText(func(text string) {})
+
+		var mu sync.Mutex
+		closedTransitions := 0
+		s.OnStateChange(func(from int, to int) {
+			if !canTransition(from, to) {
+				t.Error("Invalid transition", from, to)
+			}
+			if to == SocketStatusClosed {
+				mu.Lock()
+				closedTransitions++
+				mu.Unlock()
+			}
+		})
+
+		// the peer keeps sending messages and answers the close frame
+		go func() {
+			defer conn.Close()
+			go io.Copy(io.Discard, conn)
+			for j := 0; j < 10; j++ {
+				payload := []byte("hello")
+				if _, err := conn.Write(encodeFrame(FrameEncodeOptions{
+					r:             bytes.NewReader(payload),
+					payloadLength: uint64(len(payload)),
+					opCode:        OPCODE_TEXT,
+					fin:           true,
+					mask:          true,
+				})); err != nil {
+					return
+				}
+			}
+			payload := closePayload(CloseCodeNormal, "")
+			conn.Write(encodeFrame(FrameEncodeOptions{
+				r:             bytes.NewReader(payload),
+				payloadLength: uint64(len(payload)),
+				opCode:        OPCODE_CLOSE,
+				fin:           true,
+				mask:          true,
+			}))
+		}()
+		go s.Run()
+
+		var wg sync.WaitGroup
+		for j := 0; j < 4; j++ {
+			wg.Add(3)
+			go func() {
+				defer wg.Done()
+				s.SendMessage(MESSAGE_TYPE_TEXT, bytes.NewReader([]byte("hi")))
+			}()
+			go func() {
+				defer wg.Done()
+				s.Status()
+				s.Ping(nil)
+			}()
+			go func() {
+				defer wg.Done()
+				s.Close()
+			}()
+		}
+		wg.Wait()
+
+		if s.Status() != SocketStatusClosed {
+			t.Fatal("Socket not closed", s.Status())
+		}
+		select {
+		case <-s.Done():
+		case <-time.After(time.Second):
+			t.Fatal("Done not closed")
+		}
+		mu.Lock()
+		if closedTransitions != 1 {
+			t.Error("Unexpected number of transitions to closed", closedTransitions)
+		}
+		mu.Unlock()
+	}
+}
+
+// TestConcurrentServerClose is meant to be run with -race
+func TestConcurrentServerClose(t *testing.T) {
+	server := NewServer()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve(ln, func(err error, s Socket) {
+			if s != nil {
+				go s.Run()
+			}
+		})
+	}()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 4)
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			errs <- server.Close()
+		}()
+		go func() {
+			defer wg.Done()
+			server.Count()
+			server.Sockets()
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	succeeded := 0
+	for err := range errs {
+		if err == nil {
+			succeeded++
+		} else if err != ErrServerClosed {
+			t.Error("Unexpected close error", err)
+		}
+	}
+	if succeeded != 1 {
+		t.Error("Unexpected number of successful closes", succeeded)
+	}
+	select {
+	case err := <-served:
+		// Serve may also start after the server got closed
+		if err != nil && err != ErrServerClosed {
+			t.Error("Unexpected serve error", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("Serve did not return")
+	}
+}
+
+func TestNoDataAfterClose(t *testing.T) {
+	s, conn := newPipeSocket()
+	defer conn.Close()
+	go s.startClosingHandshake(CloseCodeNormal, "")
+	f, err := decodeFrame(decodeFrameSettings{reader: conn})
+	if err != nil || f.Opcode != OPCODE_CLOSE {
+		t.Fatal("Close frame not sent", err)
+	}
+
+	pm, err := NewPreparedMessage(MESSAGE_TYPE_TEXT, []byte("late"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := s.NextWriter(MESSAGE_TYPE_TEXT)
+	if _, err := w.Write([]byte("late")); err != ErrSocketNotOpen {
+		t.Error("Unexpected writer error", err)
+	}
+	if err := w.Close(); err != ErrSocketNotOpen {
+		t.Error("Unexpected writer close error", err)
+	}
+	if err := s.SendMessage(MESSAGE_TYPE_TEXT, bytes.NewReader([]byte("late"))); err != ErrSocketNotOpen {
+		t.Error("Unexpected send error", err)
+	}
+	if err := s.WritePreparedMessage(pm); err != ErrSocketNotOpen {
+		t.Error("Unexpected prepared send error", err)
+	}
+	if err := s.Ping(nil); err != ErrSocketNotOpen {
+		t.Error("Unexpected ping error", err)
+	}
+
+	// a writer opened before the close frame cannot send any more frames
+	s, conn = newPipeSocket()
+	defer conn.Close()
+	s.SetMaxFrameSize(4)
+	w = s.NextWriter(MESSAGE_TYPE_TEXT)
+	written := make(chan error, 1)
+	go func() {
+		_, err := w.Write([]byte("hello"))
+		written <- err
+	}()
+	if f, err := decodeFrame(decodeFrameSettings{reader: conn}); err != nil || f.Opcode != OPCODE_TEXT {
+		t.Fatal("First fragment not sent", err)
+	}
+	if err := <-written; err != nil {
+		t.Fatal("Unexpected write error", err)
+	}
+	go s.startClosingHandshake(CloseCodeNormal, "")
+	if f, err := decodeFrame(decodeFrameSettings{reader: conn, expectedContinuationMessageType: OPCODE_TEXT}); err != nil || f.Opcode != OPCODE_CLOSE {
+		t.Fatal("Close frame not sent", err)
+	}
+	if err := w.Close(); err != ErrSocketNotOpen {
+		t.Error("Unexpected writer close error", err)
+	}
+}
+
+func TestNoDataAfterCloseReply(t *testing.T) {
+	s, conn := newPipeSocket()
+	defer conn.Close()
+	sent := make(chan error, 1)
+	s.OnStateChange(func(from int, to int) {
+		if to == SocketStatusClosing {
+			// the reply to the peer close frame is not sent yet
+			sent <- s.SendMessage(MESSAGE_TYPE_TEXT, bytes.NewReader([]byte("late")))
+		}
+	})
+	go s.Run()
+
+	go writeClientFrame(conn, OPCODE_CLOSE, closePayload(CloseCodeNormal, ""), true)
+	f, err := decodeFrame(decodeFrameSettings{reader: conn})
+	if err != nil || f.Opcode != OPCODE_CLOSE {
+		t.Fatal("Close reply not sent first", err)
+	}
+	select {
+	case err := <-sent:
+		if err != ErrSocketNotOpen {
+			t.Error("Unexpected send error", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("Socket did not leave Open before the reply")
+	}
+}
@@ -0,0 +1,142 @@
+package ws
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// generateCertificate creates a self-signed certificate valid for host
+func generateCertificate(t *testing.T, host string) (tls.Certificate, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: host},
+		DNSNames:              []string{host},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, leaf
+}
+
+func TestTLSWithSNI(t *testing.T) {
+	certA, leafA := generateCertificate(t, "a.example.test")
+	certB, leafB := generateCertificate(t, "b.example.test")
+	roots := x509.NewCertPool()
+	roots.AddCert(leafA)
+	roots.AddCert(leafB)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &server{quitCh: make(chan bool)}
+	serverNames := make(chan string, 1)
+	go srv.Serve(tls.NewListener(ln, &tls.Config{Certificates: []tls.Certificate{certA, certB}}), func(err error, s Socket) {
+		if err != nil {
+			return
+		}
+		state, ok := s.TLSConnectionState()
+		if !ok {
+			t.Error("Missing server TLS state")
+		}
+		serverNames <- state.ServerName
+		go s.Run()
+	})
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	s, err := Dial(ctx, "wss://"+ln.Addr().String(), DialOptions{
+		TLSConfig: &tls.Config{ServerName: "b.example.test", RootCAs: roots},
+	})
+	if err != nil {
+		t.Fatal("Unexpected dial error", err)
+	}
+	defer s.Close()
+
+	state, ok := s.TLSConnectionState()
+	if !ok || !state.HandshakeComplete {
+		t.Fatal("Missing client TLS state")
+	}
+	if state.PeerCertificates[0].Subject.CommonName != "b.example.test" {
+		t.Error("Certificate not selected by SNI", state.PeerCertificates[0].Subject.CommonName)
+	}
+	if name := <-serverNames; name != "b.example.test" {
+		t.Error("Unexpected server name", name)
+	}
+}
+
+func TestListenTLS(t *testing.T) {
+	cert, leaf := generateCertificate(t, "localhost")
+	roots := x509.NewCertPool()
+	roots.AddCert(leaf)
+
+	srv := NewServer().(*server)
+	served := make(chan error, 1)
+	go func() {
+		served <- srv.ListenTLS("127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}}, func(err error, s Socket) {
+			if s != nil {
+				go s.Run()
+			}
+		})
+	}()
+
+	var addr string
+	waitFor(t, func() bool {
+		srv.mu.Lock()
+		defer srv.mu.Unlock()
+		if srv.listener != nil {
+			addr = srv.listener.Addr().String()
+		}
+		return addr != ""
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	s, err := Dial(ctx, "wss://"+addr, DialOptions{
+		TLSConfig: &tls.Config{ServerName: "localhost", RootCAs: roots},
+	})
+	if err != nil {
+		t.Fatal("Unexpected dial error", err)
+	}
+	if _, ok := s.TLSConnectionState(); !ok {
+		t.Error("Missing client TLS state")
+	}
+	s.Close()
+
+	srv.Close()
+	select {
+	case err := <-served:
+		if err != nil {
+			t.Error("Unexpected listen error", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("ListenTLS did not return after Close")
+	}
+}
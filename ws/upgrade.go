@@ -0,0 +1,98 @@
+package ws
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// UpgradeRequest describes a valid upgrade request before it is answered
+type UpgradeRequest struct {
+	URL        *url.URL
+	Host       string
+	Header     http.Header
+	RemoteAddr string
+	// Subprotocols and Extensions are the client offers
+	Subprotocols []string
+	Extensions   []ExtensionParams
+}
+
+// UpgradeResponse is returned by a CheckUpgrade hook.
+// A StatusCode other than 0 or 101 rejects the upgrade with that status, Header and Body,
+// otherwise the Header is added to the 101 Switching Protocols response
+type UpgradeResponse struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+	// Data is kept on the socket, typically to identify the authenticated peer
+	Data interface{}
+}
+
+// CheckUpgradeFunc inspects an upgrade request before it is answered.
+// Returning an error rejects the upgrade with the returned response,
+// or with 403 Forbidden when it does not carry a rejecting status;
+// the error is then given to the AcceptHandler, or returned by Upgrade
+type CheckUpgradeFunc func(req *UpgradeRequest) (*UpgradeResponse, error)
+
+func (r *UpgradeResponse) rejects() bool {
+	return r != nil && r.StatusCode != 0 && r.StatusCode != http.StatusSwitchingProtocols
+}
+
+// UpgradeResponse returns what the CheckUpgrade hook returned for this socket,
+// nil when there is no hook or it returned no response
+func (s *socket) UpgradeResponse() *UpgradeResponse {
+	return s.upgradeResponse
+}
+
+// checkUpgrade runs the CheckUpgrade hook of the options, if any.
+// The returned response is rejecting whenever the error is not nil
+func checkUpgrade(req *http.Request, options ServerOptions) (*UpgradeResponse, error) {
+	if options.CheckUpgrade == nil {
+		return nil, nil
+	}
+	res, err := options.CheckUpgrade(&UpgradeRequest{
+		URL:          req.URL,
+		Host:         req.Host,
+		Header:       req.Header,
+		RemoteAddr:   req.RemoteAddr,
+		Subprotocols: headerTokens(req.Header, "Sec-WebSocket-Protocol"),
+		Extensions:   parseExtensions(strings.Join(req.Header.Values("Sec-WebSocket-Extensions"), ", ")),
+	})
+	if err == nil && res.rejects() {
+		err = ErrUpgradeRejected
+	}
+	if err != nil && !res.rejects() {
+		res = &UpgradeResponse{StatusCode: http.StatusForbidden}
+	}
+	return res, err
+}
+
+// headerLines formats extra response headers, values cannot span several lines
+func headerLines(header http.Header) []string {
+	if len(header) == 0 {
+		return nil
+	}
+	var b strings.Builder
+	header.Write(&b)
+	return strings.Split(strings.TrimSuffix(b.String(), "\r\n"), "\r\n")
+}
+
+// writeUpgradeRejection answers a request rejected by CheckUpgrade on a raw connection
+func writeUpgradeRejection(w io.Writer, rejection *UpgradeResponse) error {
+	header := rejection.Header.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+	header.Set("Connection", "close")
+	res := &http.Response{
+		StatusCode:    rejection.StatusCode,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(rejection.Body)),
+		ContentLength: int64(len(rejection.Body)),
+	}
+	return res.Write(w)
+}
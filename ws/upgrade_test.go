@@ -0,0 +1,137 @@
+package ws
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func checkToken(req *UpgradeRequest) (*UpgradeResponse, error) {
+	switch req.URL.Query().Get("token") {
+	case "":
+		return &UpgradeResponse{
+			StatusCode: http.StatusUnauthorized,
+			Header:     http.Header{"Www-Authenticate": {`Bearer realm="ws"`}},
+			Body:       []byte("token required"),
+		}, nil
+	case "secret":
+		return &UpgradeResponse{
+			Header: http.Header{"Set-Cookie": {"session=1"}},
+			Data:   "alice",
+		}, nil
+	}
+	return nil, errors.New("invalid token")
+}
+
+func TestCheckUpgrade(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewServerWithOptions(ServerOptions{CheckUpgrade: checkToken})
+	defer srv.Close()
+	accepted := make(chan error, 1)
+	sockets := make(chan Socket, 1)
+	go srv.Serve(ln, func(err error, s Socket) {
+		accepted <- err
+		if err == nil {
+			sockets <- s
+			go s.Run()
+		}
+	})
+
+	handshake := func(query string) *http.Response {
+		t.Helper()
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		conn.Write([]byte(strings.Join([]string{
+			"GET /?" + query + " HTTP/1.1",
+			"Host: localhost",
+			"Connection: Upgrade",
+			"Upgrade: websocket",
+			"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==",
+			"Sec-WebSocket-Version: 13",
+			"\r\n",
+		}, "\r\n")))
+		res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	res := handshake("")
+	body, _ := io.ReadAll(res.Body)
+	if res.StatusCode != http.StatusUnauthorized || res.Header.Get("WWW-Authenticate") == "" || string(body) != "token required" {
+		t.Error("Unexpected rejection", res.StatusCode, res.Header, string(body))
+	}
+	if err := <-accepted; err != ErrUpgradeRejected {
+		t.Error("Unexpected accept error", err)
+	}
+
+	res = handshake("token=wrong")
+	if res.StatusCode != http.StatusForbidden {
+		t.Error("Unexpected status code", res.StatusCode)
+	}
+	if err := <-accepted; err == nil || err.Error() != "invalid token" {
+		t.Error("Hook error not reported", err)
+	}
+
+	res = handshake("token=secret")
+	if res.StatusCode != http.StatusSwitchingProtocols || res.Header.Get("Set-Cookie") != "session=1" {
+		t.Error("Unexpected response", res.StatusCode, res.Header)
+	}
+	if err := <-accepted; err != nil {
+		t.Fatal("Unexpected accept error", err)
+	}
+	if s := <-sockets; s.UpgradeResponse() == nil || s.UpgradeResponse().Data != "alice" {
+		t.Error("Hook response not kept on the socket")
+	}
+}
+
+func TestUpgraderCheckUpgrade(t *testing.T) {
+	upgrader := NewUpgraderWithOptions(ServerOptions{
+		CheckUpgrade: func(req *UpgradeRequest) (*UpgradeResponse, error) {
+			return &UpgradeResponse{
+				StatusCode: http.StatusTooManyRequests,
+				Header:     http.Header{"Retry-After": {"30"}},
+			}, nil
+		},
+	})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := upgrader.Upgrade(w, r); err != ErrUpgradeRejected {
+			t.Error("Unexpected upgrade error", err)
+		}
+	}))
+	defer srv.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusTooManyRequests || res.Header.Get("Retry-After") != "30" {
+		t.Error("Unexpected rejection", res.StatusCode, res.Header)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := Dial(ctx, "ws"+strings.TrimPrefix(srv.URL, "http"), DialOptions{}); err != ErrUnexpectedStatus {
+		t.Error("Unexpected dial error", err)
+	}
+}
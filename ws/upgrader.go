@@ -0,0 +1,88 @@
+package ws
+
+import (
+	"net/http"
+	"time"
+)
+
+// Upgrader turns requests received by a net/http server into websockets,
+// applying the same validation rules as the standalone server handshake
+type Upgrader struct {
+	options ServerOptions
+}
+
+func NewUpgrader() *Upgrader {
+	return NewUpgraderWithOptions(ServerOptions{})
+}
+
+func NewUpgraderWithOptions(options ServerOptions) *Upgrader {
+	return &Upgrader{
+		options: options,
+	}
+}
+
+// Upgrade validates the request and hijacks the underlying connection.
+// When the request is not a valid websocket upgrade an HTTP error is written
+// to w and the returned error describes the failure.
+// As with the sockets given to an AcceptHandler, Run must be called on the
+// returned socket to start processing incoming frames
+func (u *Upgrader) Upgrade(w http.ResponseWriter, r *http.Request) (Socket, error) {
+	s := newSocket(nil, nil)
+	s.applyOptions(u.options.SocketOptions)
+	response, err := s.acceptUpgrade(r, u.options)
+	if err != nil {
+		if s.upgradeResponse.rejects() {
+			writeRejection(w, s.upgradeResponse)
+		} else {
+			writeHandshakeError(w, err)
+		}
+		return nil, err
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, ErrHijackUnsupported.Error(), http.StatusInternalServerError)
+		return nil, ErrHijackUnsupported
+	}
+
+	conn, bufrw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	// the connection keeps the deadlines set by the http.Server timeouts
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if _, err := bufrw.WriteString(response); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := bufrw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	s.rwc = conn
+	// the client may have sent frames along with the request
+	s.br = bufrw.Reader
+	s.setStatus(SocketStatusOpen)
+	return s, nil
+}
+
+func writeRejection(w http.ResponseWriter, rejection *UpgradeResponse) {
+	for key, values := range rejection.Header {
+		w.Header()[key] = values
+	}
+	w.WriteHeader(rejection.StatusCode)
+	w.Write(rejection.Body)
+}
+
+func writeHandshakeError(w http.ResponseWriter, err error) {
+	status, header := handshakeFailure(err)
+	for key, values := range header {
+		w.Header()[key] = values
+	}
+	http.Error(w, err.Error(), status)
+}
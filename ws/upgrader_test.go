@@ -0,0 +1,119 @@
+package ws
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUpgraderRejectsPlainRequest(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := NewUpgrader().Upgrade(w, r); err != ErrMissingUpgrade {
+			t.Error("Unexpected upgrade error", err)
+		}
+	}))
+	defer srv.Close()
+
+	res, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusUpgradeRequired {
+		t.Error("Unexpected status code", res.StatusCode)
+	}
+}
+
+func TestUpgraderHijacksConnection(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s, err := NewUpgrader().Upgrade(w, r)
+		if err != nil {
+			t.Error("Unexpected upgrade error", err)
+			return
+		}
+		go s.Run()
+	}))
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(srv.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.Write([]byte(strings.Join([]string{
+		"GET / HTTP/1.1",
+		"Host: " + conn.RemoteAddr().String(),
+		"Connection: Upgrade",
+		"Upgrade: websocket",
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==",
+		"Sec-WebSocket-Version: 13",
+		"\r\n",
+	}, "\r\n")))
+
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatal("Unexpected status code", res.StatusCode)
+	}
+	if res.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Error("Unexpected accept key", res.Header.Get("Sec-WebSocket-Accept"))
+	}
+
+	payloadReader := bytes.NewReader([]byte("hello"))
+	conn.Write(encodeFrame(FrameEncodeOptions{
+		r:             payloadReader,
+		payloadLength: uint64(payloadReader.Len()),
+		opCode:        OPCODE_PING,
+		fin:           true,
+		mask:          true,
+	}))
+
+	frame, err := decodeFrame(decodeFrameSettings{reader: br})
+	if err != nil {
+		t.Fatal("Unexpected error while decoding frame", err)
+	}
+	if frame.Opcode != OPCODE_PONG || string(frame.Payload) != "hello" {
+		t.Error("Unexpected reply", frame.Opcode, string(frame.Payload))
+	}
+}
+
+// deadlineHijacker hands over a connection carrying an expired deadline,
+// as older net/http versions do when the server has timeouts
+type deadlineHijacker struct {
+	*httptest.ResponseRecorder
+	conn net.Conn
+}
+
+func (h *deadlineHijacker) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h.conn.SetDeadline(time.Now().Add(-time.Second))
+	return h.conn, bufio.NewReadWriter(bufio.NewReader(h.conn), bufio.NewWriter(h.conn)), nil
+}
+
+func TestUpgraderClearsServerDeadlines(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	go io.Copy(io.Discard, clientConn)
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Connection", "Upgrade")
+	r.Header.Set("Upgrade", "websocket")
+	r.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	r.Header.Set("Sec-WebSocket-Version", "13")
+	s, err := NewUpgrader().Upgrade(&deadlineHijacker{httptest.NewRecorder(), serverConn}, r)
+	if err != nil {
+		t.Fatal("Socket killed by the server deadlines", err)
+	}
+	if err := s.SendMessage(MESSAGE_TYPE_TEXT, strings.NewReader("alive")); err != nil {
+		t.Error("Unexpected send error", err)
+	}
+}
@@ -0,0 +1,94 @@
+package ws
+
+import (
+	"bytes"
+	"io"
+)
+
+// NextWriter returns a writer for a new message. Written data is sent as soon as
+// more than a max frame size is buffered, the first frame carrying the message type
+// and the following ones OPCODE_CONTINUATION; Close sends the final frame.
+// When extensions are negotiated the message is buffered until Close.
+// Other messages wait for the writer to be closed, control frames do not.
+// Once the socket is not open the writer fails with ErrSocketNotOpen
+func (s *socket) NextWriter(t MessageType) io.WriteCloser {
+	if t != MESSAGE_TYPE_TEXT && t != MESSAGE_TYPE_BINARY {
+		return &messageWriter{err: ErrInvalidMessageType, closed: true}
+	}
+	s.messageMu.Lock()
+	if s.Status() != SocketStatusOpen {
+		s.messageMu.Unlock()
+		return &messageWriter{err: ErrSocketNotOpen, closed: true}
+	}
+	return &messageWriter{s: s, opcode: byte(t)}
+}
+
+// messageWriter holds the message lock of its socket until closed
+type messageWriter struct {
+	s       *socket
+	opcode  byte
+	buf     []byte
+	started bool
+	closed  bool
+	err     error
+}
+
+func (w *messageWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	if w.closed {
+		return 0, ErrWriterClosed
+	}
+	buffered := len(w.buf)
+	w.buf = append(w.buf, p...)
+	if len(w.s.extensions) > 0 {
+		return len(p), nil
+	}
+
+	// the last frame is only sent on Close, so that it can carry FIN
+	size := w.s.frameSize()
+	sent := 0
+	for len(w.buf) > size {
+		if err := w.flush(w.buf[:size], false); err != nil {
+			// only the bytes of p in the frames sent before count as written
+			if sent > buffered {
+				return sent - buffered, err
+			}
+			return 0, err
+		}
+		w.buf = w.buf[size:]
+		sent += size
+	}
+	return len(p), nil
+}
+
+func (w *messageWriter) Close() error {
+	if w.closed {
+		return w.err
+	}
+	w.closed = true
+	defer w.s.messageMu.Unlock()
+	if w.err != nil {
+		return w.err
+	}
+
+	if len(w.s.extensions) == 0 {
+		return w.flush(w.buf, true)
+	}
+	encoded, rsv, err := w.s.encodeMessage(w.opcode, w.buf)
+	if err != nil {
+		return err
+	}
+	return w.s.sendFragments(w.opcode, rsv, bytes.NewReader(encoded))
+}
+
+func (w *messageWriter) flush(payload []byte, fin bool) error {
+	opcode := w.opcode
+	if w.started {
+		opcode = OPCODE_CONTINUATION
+	}
+	w.started = true
+	w.err = w.s.sendFrame(opcode, bytes.NewReader(payload), fin)
+	return w.err
+}
@@ -0,0 +1,85 @@
+package ws
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestNextWriter(t *testing.T) {
+	s, conn := newPipeSocket()
+	s.SetMaxFrameSize(8)
+
+	w := s.NextWriter(MESSAGE_TYPE_TEXT)
+	closeWriter := make(chan struct{})
+	closed := make(chan struct{})
+	go func() {
+		w.Write([]byte("0123456789abcdefghij"))
+		<-closeWriter
+		w.Close()
+		close(closed)
+	}()
+
+	expect := func(opcode byte, payload string, fin bool) {
+		t.Helper()
+		settings := decodeFrameSettings{reader: conn}
+		if opcode == OPCODE_CONTINUATION {
+			settings.expectedContinuationMessageType = OPCODE_TEXT
+		}
+		f, err := decodeFrame(settings)
+		if err != nil || f.Opcode != opcode || string(f.Payload) != payload || f.Fin != fin {
+			t.Fatal("Unexpected frame", f, err)
+		}
+	}
+
+	// full frames are sent while the writer is open
+	expect(OPCODE_TEXT, "01234567", false)
+	expect(OPCODE_CONTINUATION, "89abcdef", false)
+
+	go s.Ping([]byte("ping"))
+	expect(OPCODE_PING, "ping", true)
+
+	close(closeWriter)
+	expect(OPCODE_CONTINUATION, "ghij", true)
+	<-closed
+
+	if _, err := w.Write([]byte("late")); err != ErrWriterClosed {
+		t.Error("Write after close accepted", err)
+	}
+
+	// the message lock is released on close
+	go s.SendMessage(MESSAGE_TYPE_BINARY, bytes.NewReader([]byte("next")))
+	expect(OPCODE_BINARY, "next", true)
+}
+
+func TestNextWriterInvalidType(t *testing.T) {
+	s, _ := newPipeSocket()
+	w := s.NextWriter(MessageType(OPCODE_PING))
+	if _, err := w.Write([]byte("ping")); err != ErrInvalidMessageType {
+		t.Error("Unexpected error", err)
+	}
+	if err := w.Close(); err != ErrInvalidMessageType {
+		t.Error("Unexpected error", err)
+	}
+}
+
+func TestNextWriterPartialWrite(t *testing.T) {
+	s, conn := newPipeSocket()
+	s.SetMaxFrameSize(4)
+
+	w := s.NextWriter(MESSAGE_TYPE_TEXT)
+	w.Write([]byte("ab"))
+	written := make(chan int, 1)
+	go func() {
+		n, _ := w.Write([]byte("cdefghijkl"))
+		written <- n
+	}()
+
+	// the peer goes away after the first frame
+	if _, err := decodeFrame(decodeFrameSettings{reader: conn}); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if n := <-written; n != 2 {
+		t.Error("Unexpected written count", n)
+	}
+}